@@ -0,0 +1,102 @@
+/*
+Copyright © 2021 Wilson Husin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	encjson "encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/wilsonehusin/confiar/internal/audit"
+)
+
+var auditFilter audit.Filter
+var auditSince time.Duration
+var auditJSON bool
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Inspect audit logs",
+	Long: `confiar audit -- inspect audit logs
+
+Audit logs are written by serve, install and uninstall when given --audit-log.`,
+}
+
+var auditLogCmd = &cobra.Command{
+	Use:   "log",
+	Short: "Query audit log events",
+	Long: `confiar audit log -- query audit log events
+
+Reads the file given by --audit-log along with its rotated backups, oldest
+events first. Filters are combined, only events matching all of them are shown.`,
+	Args: cobra.NoArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if auditLogPath == "" {
+			return fmt.Errorf("--audit-log is required")
+		}
+		if auditSince > 0 {
+			auditFilter.Since = time.Now().Add(-auditSince)
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		events, err := audit.Query(auditLogPath, &auditFilter)
+		if err != nil {
+			return err
+		}
+		if auditJSON {
+			encoder := encjson.NewEncoder(os.Stdout)
+			for _, e := range events {
+				if err := encoder.Encode(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tACTION\tRESULT\tCLIENT\tFINGERPRINT\tNAMES")
+		for _, e := range events {
+			fingerprint := e.Fingerprint
+			if len(fingerprint) > 16 {
+				fingerprint = fingerprint[:16]
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				e.Time.Format(time.RFC3339), e.Action, e.Result, e.Client, fingerprint,
+				strings.Join(append(e.Names, e.IPs...), ","))
+		}
+		return w.Flush()
+	},
+}
+
+func init() {
+	auditLogCmd.Flags().StringVar(&auditLogPath, "audit-log", "", "audit log file to read")
+	auditLogCmd.Flags().StringVar(&auditFilter.Action, "action", "", "only show events of this action (download, issue, install, uninstall)")
+	auditLogCmd.Flags().StringVar(&auditFilter.Client, "client", "", "only show events from this client address or hostname")
+	auditLogCmd.Flags().StringVar(&auditFilter.Fingerprint, "fingerprint", "", "only show events for certificates whose SHA-256 fingerprint starts with this")
+	auditLogCmd.Flags().StringVar(&auditFilter.Name, "name", "", "only show events for certificates with this domain name")
+	auditLogCmd.Flags().DurationVar(&auditSince, "since", 0, "only show events newer than this, e.g. 24h")
+	auditLogCmd.Flags().BoolVar(&auditJSON, "output-json", false, "print matching events as JSON lines")
+
+	auditCmd.AddCommand(auditLogCmd)
+	rootCmd.AddCommand(auditCmd)
+}
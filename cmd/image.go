@@ -0,0 +1,71 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/wilsonehusin/confiar/internal"
+)
+
+var imageConfig internal.ImageConfig
+
+var imageCmd = &cobra.Command{
+	Use:   "image",
+	Short: "Modify container images",
+	Long: `confiar image -- modify container images
+
+Works on OCI image layouts, as a directory or tarball, such as the ones
+written by skopeo copy oci:<dir> or docker save on Docker 25 and later. The
+manifest.json and repositories files docker save adds are updated as well,
+so that docker load picks up the result.`,
+}
+
+var imageAddCACmd = &cobra.Command{
+	Use:   "add-ca",
+	Short: "Adds the certificate to the image's trust store",
+	Long: `confiar image add-ca -- let your container image trust your certificate
+
+Appends a layer to the image which places the certificate where the image's
+distribution expects it, detected from its os-release, along with an updated
+bundle. Nothing runs inside the image, so this works for images of any
+architecture. Multi-platform images get a layer for every platform.
+
+The image is updated in place unless --tag is given, then the result is
+added to the same layout under the new tag.`,
+	Args: cobra.NoArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if imageConfig.Image == "" {
+			return fmt.Errorf("--image is required")
+		}
+		imageConfig.CertSrc = certSrc
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return internal.AddCAToImage(&imageConfig)
+	},
+}
+
+func init() {
+	imageAddCACmd.Flags().StringVar(&imageConfig.Image, "image", "", "OCI image layout directory or tarball, with :tag to pick one of several images")
+	imageAddCACmd.Flags().StringVarP(&certSrc, "from", "f", "./cert.pem", "where to find the certificate: path, file://, http(s):// or - for stdin")
+	imageAddCACmd.Flags().StringVar(&imageConfig.Tag, "tag", "", "store the result under this tag instead of replacing the image")
+	imageCmd.AddCommand(imageAddCACmd)
+	rootCmd.AddCommand(imageCmd)
+}
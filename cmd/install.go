@@ -17,12 +17,34 @@ limitations under the License.
 package cmd
 
 import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
 	"github.com/spf13/cobra"
 
 	"github.com/wilsonehusin/confiar/internal"
+	"github.com/wilsonehusin/confiar/internal/keystore"
 )
 
 var installTarget string
+var installWatch bool
+var installInterval time.Duration
+var javaHome string
+var keystorePassword string
+var registryPorts []int
+var rootless bool
+var homeDir string
+var dryRun bool
+var buildkitConfig string
+var runnerDockerVolumes bool
+var certDir string
+var filePath string
+var fileOwner string
+var fileModeFlag string
+var fileMode os.FileMode
+var hostsAddress string
 
 // installCmd represents the install command
 var installCmd = &cobra.Command{
@@ -34,19 +56,120 @@ For targets requiring specific hostnames to be mapped to each certificate,
 confiar will automatically parse the information from the given certificate.
 
 You can pass additional --fqdn or --ip for hostnames which were not included
-in the certificate.`,
+in the certificate.
+
+With --watch, confiar keeps running and checks the certificate every
+--interval, installing it again only when it has changed. Remote sources served
+by confiar serve are checked cheaply with conditional requests.`,
 	PreRunE: func(cmd *cobra.Command, args []string) error {
-		return validateNameAndIP(true)
+		if err := validateNameAndIP(false); err != nil {
+			return err
+		}
+		if err := validateTargetFlags(); err != nil {
+			return err
+		}
+		if installWatch && installInterval <= 0 {
+			return fmt.Errorf("--interval must be positive")
+		}
+		if installWatch && certSrc == "-" {
+			return fmt.Errorf("--watch cannot read the certificate from stdin, stdin is consumed by the first install")
+		}
+		return openAuditLog()
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return internal.InstallTLS(certSrc, installTarget, names, ips)
+		config := installConfig()
+		if installWatch {
+			return internal.WatchTLS(config, installInterval)
+		}
+		return internal.InstallTLS(config)
 	},
 }
 
 func init() {
-	installCmd.Flags().StringVarP(&installTarget, "target", "t", "stdout", "installation target")
-	installCmd.Flags().StringVarP(&certSrc, "from", "f", "./cert.pem", "where to find the certificate")
-	installCmd.Flags().StringVar(&nameList, "fqdn", "", "additional domain name(s) for certificate (comma separated)")
-	installCmd.Flags().StringVar(&ipList, "ip", "", "additional IP address(es) for certificate (comma separated)")
+	addTargetFlags(installCmd)
+	installCmd.Flags().BoolVar(&installWatch, "watch", false, "keep running and install again whenever the certificate changes")
+	installCmd.Flags().DurationVar(&installInterval, "interval", 10*time.Minute, "how often to check the certificate when watching")
+	addAuditLogFlags(installCmd)
 	rootCmd.AddCommand(installCmd)
 }
+
+// flags shared between install and uninstall
+
+func addTargetFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&installTarget, "target", "t", "stdout", "installation target (stdout, docker, containerd, containers, k3s, rke2, buildkit, gitlab-runner, toolchains, openssl-dir, file, hosts, system, debian, rhel, alpine, arch, suse, nss, java)")
+	cmd.Flags().StringVarP(&certSrc, "from", "f", "./cert.pem", "where to find the certificate: path, file://, http(s):// or - for stdin")
+	cmd.Flags().StringVar(&nameList, "fqdn", "", "additional domain name(s) for certificate (comma separated)")
+	cmd.Flags().StringVar(&ipList, "ip", "", "additional IP address(es) for certificate (comma separated)")
+	cmd.Flags().StringVar(&javaHome, "java-home", "", "only use the JDK installed here (target: java)")
+	cmd.Flags().StringVar(&keystorePassword, "keystore-password", keystore.DefaultPassword, "integrity password of cacerts (target: java)")
+	cmd.Flags().IntSliceVar(&registryPorts, "registry-port", nil, "also trust the certificate for hostname:port (target: containers)")
+	cmd.Flags().BoolVar(&rootless, "rootless", false, "install for the current user instead of system-wide (target: containers, buildkit, gitlab-runner, toolchains)")
+	cmd.Flags().StringVar(&homeDir, "home", "", "home directory of the user to configure instead of the current user's, inside --root (target: nss, and containers, buildkit, gitlab-runner, toolchains with --rootless)")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "show the configuration changes without making them (target: k3s, rke2, buildkit, gitlab-runner)")
+	cmd.Flags().StringVar(&buildkitConfig, "buildkit-config", "", "buildkitd.toml to update instead of the default location (target: buildkit)")
+	cmd.Flags().BoolVar(&runnerDockerVolumes, "runner-docker-volumes", false, "also mount the certificates into docker executor jobs (target: gitlab-runner)")
+	cmd.Flags().StringVar(&certDir, "cert-dir", "", "hashed certificate directory, as used by SSL_CERT_DIR (target: openssl-dir)")
+	cmd.Flags().StringVar(&filePath, "path", "", "where to write the certificate, {{.Host}} writes one per hostname (target: file)")
+	cmd.Flags().StringVar(&fileOwner, "owner", "", "user[:group] owning the written files (target: file)")
+	cmd.Flags().StringVar(&fileModeFlag, "mode", "0644", "permissions of the written files, in octal (target: file)")
+	cmd.Flags().StringVar(&hostsAddress, "address", "", "IP address the names resolve to instead of the certificate's (target: hosts)")
+}
+
+func installConfig() *internal.InstallConfig {
+	return &internal.InstallConfig{
+		CertSrc:    certSrc,
+		Target:     installTarget,
+		ExtraNames: names,
+		ExtraIPs:   ips,
+		Root:       rootDir,
+
+		SkipCommands: skipCommands,
+
+		JavaHome:         javaHome,
+		KeystorePassword: keystorePassword,
+
+		RegistryPorts:  registryPorts,
+		Rootless:       rootless,
+		BuildkitConfig: buildkitConfig,
+
+		Home: homeDir,
+
+		RunnerDockerVolumes: runnerDockerVolumes,
+
+		CertDir: certDir,
+
+		FilePath:  filePath,
+		FileOwner: fileOwner,
+		FileMode:  fileMode,
+
+		HostsAddress: hostsAddress,
+
+		DryRun: dryRun,
+	}
+}
+
+func validateTargetFlags() error {
+	if info, err := os.Stat(rootDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("\"%v\" is not a directory", rootDir)
+	}
+	for _, port := range registryPorts {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("\"%v\" is not a valid port", port)
+		}
+	}
+	if hostsAddress != "" && !internal.ValidIPAddr(hostsAddress) {
+		return fmt.Errorf("\"%v\" is not a valid IP address", hostsAddress)
+	}
+	if homeDir != "" && !rootless {
+		switch installTarget {
+		case "containers", "buildkit", "gitlab-runner", "toolchains":
+			return fmt.Errorf("--home only applies with --rootless for target %s", installTarget)
+		}
+	}
+	mode, err := strconv.ParseUint(fileModeFlag, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("\"%v\" is not a valid file mode", fileModeFlag)
+	}
+	fileMode = os.FileMode(mode)
+	return nil
+}
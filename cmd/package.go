@@ -0,0 +1,69 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/wilsonehusin/confiar/internal"
+)
+
+var packageConfig internal.PackageConfig
+
+var packageCmd = &cobra.Command{
+	Use:   "package",
+	Short: "Build a .deb or .rpm package of the certificate",
+	Long: `confiar package -- trust your certificate through your package manager
+
+Builds a package which places the certificate in the system trust store and
+updates the bundle after installation and removal. Packages are built
+natively, neither dpkg-deb nor rpmbuild are needed.
+
+By default .deb packages follow Debian and .rpm packages follow Fedora / RHEL,
+use --distro suse for an .rpm installing into SUSE's trust store instead.
+The version defaults to the certificate's start of validity, so packages of a
+renewed certificate upgrade the previous one.`,
+	Args: cobra.NoArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if packageConfig.Format != "deb" && packageConfig.Format != "rpm" {
+			return fmt.Errorf("--format must be deb or rpm")
+		}
+		if packageConfig.Maintainer == "" {
+			return fmt.Errorf("--maintainer is required, e.g. \"Platform Team <platform@example.com>\"")
+		}
+		packageConfig.CertSrc = certSrc
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		_, err := internal.BuildPackage(&packageConfig)
+		return err
+	},
+}
+
+func init() {
+	packageCmd.Flags().StringVar(&packageConfig.Format, "format", "", "package format: deb or rpm")
+	packageCmd.Flags().StringVarP(&certSrc, "from", "f", "./cert.pem", "where to find the certificate: path, file://, http(s):// or - for stdin")
+	packageCmd.Flags().StringVar(&packageConfig.Distro, "distro", "", "trust store layout to follow (default debian for deb, rhel for rpm)")
+	packageCmd.Flags().StringVar(&packageConfig.Name, "name", "", "package name (default confiar-ca-<hostname>)")
+	packageCmd.Flags().StringVar(&packageConfig.Version, "version", "", "package version (default derived from the certificate)")
+	packageCmd.Flags().StringVar(&packageConfig.Release, "release", "1", "package release")
+	packageCmd.Flags().StringVar(&packageConfig.Maintainer, "maintainer", "", "package maintainer as \"name <email>\" (required)")
+	packageCmd.Flags().StringVar(&packageConfig.OutDir, "out-dir", ".", "directory where the package will be written to")
+	rootCmd.AddCommand(packageCmd)
+}
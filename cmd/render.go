@@ -0,0 +1,79 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/wilsonehusin/confiar/internal"
+)
+
+var renderDocker bool
+
+var renderCmd = &cobra.Command{
+	Use:   "render",
+	Short: "Render provisioning configuration trusting the certificate",
+	Long: `confiar render -- trust your certificate from the first boot
+
+Prints configuration for machines to trust the certificate as soon as they are
+provisioned, instead of installing it afterwards. With --docker, the
+certificate is also placed in /etc/docker/certs.d for the same hostnames as
+confiar install --target docker would.`,
+}
+
+var renderCloudInitCmd = &cobra.Command{
+	Use:   "cloud-init",
+	Short: "Render cloud-config using the ca_certs module",
+	Args:  cobra.NoArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return validateNameAndIP(false)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return internal.RenderCloudInit(renderConfig(), cmd.OutOrStdout())
+	},
+}
+
+var renderIgnitionCmd = &cobra.Command{
+	Use:   "ignition",
+	Short: "Render an Ignition config for Fedora CoreOS",
+	Args:  cobra.NoArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return validateNameAndIP(false)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return internal.RenderIgnition(renderConfig(), cmd.OutOrStdout())
+	},
+}
+
+func renderConfig() *internal.RenderConfig {
+	return &internal.RenderConfig{
+		CertSrc:    certSrc,
+		ExtraNames: names,
+		ExtraIPs:   ips,
+		Docker:     renderDocker,
+	}
+}
+
+func init() {
+	renderCmd.PersistentFlags().StringVarP(&certSrc, "from", "f", "./cert.pem", "where to find the certificate: path, file://, http(s):// or - for stdin")
+	renderCmd.PersistentFlags().BoolVar(&renderDocker, "docker", false, "also write the certificate to Docker's certs.d for every hostname")
+	renderCmd.PersistentFlags().StringVar(&nameList, "fqdn", "", "additional domain name(s) for Docker (comma separated)")
+	renderCmd.PersistentFlags().StringVar(&ipList, "ip", "", "additional IP address(es) for Docker (comma separated)")
+	renderCmd.AddCommand(renderCloudInitCmd)
+	renderCmd.AddCommand(renderIgnitionCmd)
+	rootCmd.AddCommand(renderCmd)
+}
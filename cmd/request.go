@@ -0,0 +1,65 @@
+/*
+Copyright © 2021 Wilson Husin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/wilsonehusin/confiar/internal"
+)
+
+var issuerSrc string
+
+// requestCmd represents the request command
+var requestCmd = &cobra.Command{
+	Use:   "request",
+	Short: "Request TLS certificate from a confiar server",
+	Long: `confiar request -- get a certificate signed by a confiar server
+
+A new private key is generated locally and only its certificate signing request
+is sent to the server given by --from, which must be running confiar serve
+with --key. The server needs to be given the same token as --token (or
+CONFIAR_TOKEN).
+
+Files will be created in working directory as cert.pem and key.pem, if any of
+those files already exist, they will be overwritten.`,
+	Args: cobra.NoArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		resolveToken()
+		if issuerSrc == "" {
+			return fmt.Errorf("--from is required")
+		}
+		if token == "" {
+			return fmt.Errorf("--token or %s is required", tokenEnv)
+		}
+		return validateNameAndIP(true)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return internal.RequestTLS("gostd", issuerSrc, token, names, ips, outDir)
+	},
+}
+
+func init() {
+	requestCmd.Flags().StringVarP(&issuerSrc, "from", "f", "", "address of confiar server, e.g. http://10.11.12.13:8787")
+	requestCmd.Flags().StringVar(&token, "token", "", "token accepted by the server (default $"+tokenEnv+")")
+	requestCmd.Flags().StringVar(&outDir, "out-dir", ".", "directory where certificate will be written to")
+	requestCmd.Flags().StringVar(&nameList, "fqdn", "", "domain name(s) for certificate (comma separated)")
+	requestCmd.Flags().StringVar(&ipList, "ip", "", "IP address(es) for certificate (comma separated)")
+	rootCmd.AddCommand(requestCmd)
+}
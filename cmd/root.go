@@ -29,10 +29,13 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/wilsonehusin/confiar/internal"
+	"github.com/wilsonehusin/confiar/internal/audit"
 )
 
 var debug bool
 var json bool
+var rootDir string
+var skipCommands bool
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -58,7 +61,10 @@ And maybe it doesn't make sense to do that either, so let's do it together!`,
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	err := rootCmd.Execute()
+	// os.Exit skips deferred calls
+	audit.Close()
+	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
@@ -86,11 +92,20 @@ func prepareLogger() {
 		// turn on pretty logging
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
 	}
+
+	// fatal logs exit right away, close the audit log before that happens
+	log.Logger = log.Hook(zerolog.HookFunc(func(e *zerolog.Event, level zerolog.Level, msg string) {
+		if level == zerolog.FatalLevel {
+			audit.Close()
+		}
+	}))
 }
 
 func init() {
 	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "toggle debug logs")
 	rootCmd.PersistentFlags().BoolVar(&json, "json", false, "print logs as json")
+	rootCmd.PersistentFlags().StringVar(&rootDir, "root", "/", "operate on this root directory, such as a mounted image, instead of the host's")
+	rootCmd.PersistentFlags().BoolVar(&skipCommands, "skip-commands", false, "do not run commands inside --root through chroot, update files only")
 }
 
 // not used in this file, but shared usage between different subcommands
@@ -102,6 +117,16 @@ var ipList string
 var names []string
 var ips []string
 
+const tokenEnv = "CONFIAR_TOKEN"
+
+var token string
+
+func resolveToken() {
+	if token == "" {
+		token = os.Getenv(tokenEnv)
+	}
+}
+
 func validateNameAndIP(required bool) error {
 	if nameList != "" {
 		names = strings.Split(nameList, ",")
@@ -126,3 +151,23 @@ func validateNameAndIP(required bool) error {
 
 	return nil
 }
+
+var auditLogPath string
+var auditLogMaxSize int64
+var auditLogMaxBackups int
+
+func addAuditLogFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&auditLogPath, "audit-log", "", "append audit events as JSON lines to this file")
+	cmd.Flags().Int64Var(&auditLogMaxSize, "audit-log-max-size", 10, "size in MiB at which the audit log is rotated")
+	cmd.Flags().IntVar(&auditLogMaxBackups, "audit-log-max-backups", 5, "number of rotated audit logs to keep, 0 keeps all of them")
+}
+
+func openAuditLog() error {
+	if auditLogPath == "" {
+		return nil
+	}
+	if auditLogMaxBackups < 0 {
+		return fmt.Errorf("--audit-log-max-backups cannot be negative")
+	}
+	return audit.Open(auditLogPath, auditLogMaxSize*1024*1024, auditLogMaxBackups)
+}
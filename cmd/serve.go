@@ -23,6 +23,9 @@ import (
 )
 
 var servePort int
+var serveKey string
+var metricsAddr string
+var metricsClientLabel bool
 
 var serveCmd = &cobra.Command{
 	Use:   "serve",
@@ -31,16 +34,43 @@ var serveCmd = &cobra.Command{
 
 Sharing the generated certificate with other hosts. Clients who would like to
 trust this certificate can run install using --from flag with current host as
-address, e.g. --from http://10.11.12.13:8787`,
+address, e.g. --from http://10.11.12.13:8787
+
+When --key is given, clients holding the token (--token or CONFIAR_TOKEN) may
+also request their own certificates signed by the served certificate through
+POST /issue, see confiar request --help.
+
+Health (/healthz, /readyz) and Prometheus metrics (/metrics) endpoints are
+served on the same port, or on --metrics-addr when given.
+
+Every download and issuance can be recorded with --audit-log, see confiar audit
+log --help.`,
 	Args: cobra.NoArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		resolveToken()
+		return openAuditLog()
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return internal.ServeCertificate(certSrc, servePort)
+		return internal.ServeCertificate(&internal.ServeConfig{
+			CertPath: certSrc,
+			Port:     servePort,
+			KeyPath:  serveKey,
+			Token:    token,
+
+			MetricsAddr:        metricsAddr,
+			MetricsClientLabel: metricsClientLabel,
+		})
 	},
 }
 
 func init() {
 	serveCmd.Flags().StringVarP(&certSrc, "from", "f", "./cert.pem", "where to find the certificate")
 	serveCmd.Flags().IntVarP(&servePort, "port", "p", 8787, "port to serve the certificate")
+	serveCmd.Flags().StringVar(&serveKey, "key", "", "private key of the certificate, enables issuing certificates")
+	serveCmd.Flags().StringVar(&metricsAddr, "metrics-addr", "", "separate address for health and metrics endpoints, e.g. 127.0.0.1:9787")
+	serveCmd.Flags().BoolVar(&metricsClientLabel, "metrics-client-label", false, "label downloads with the client address, one series per client")
+	serveCmd.Flags().StringVar(&token, "token", "", "token required from clients to issue certificates (default $"+tokenEnv+")")
+	addAuditLogFlags(serveCmd)
 
 	rootCmd.AddCommand(serveCmd)
 }
@@ -0,0 +1,51 @@
+/*
+Copyright © 2021 Wilson Husin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/wilsonehusin/confiar/internal"
+)
+
+// uninstallCmd represents the uninstall command
+var uninstallCmd = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Removes certificates from the defined target",
+	Long: `confiar uninstall -- stop trusting your certificate
+
+Removes what confiar install placed in the target for the given certificate,
+so it takes the same flags as install. Not every target supports this.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := validateNameAndIP(false); err != nil {
+			return err
+		}
+		if err := validateTargetFlags(); err != nil {
+			return err
+		}
+		return openAuditLog()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return internal.UninstallTLS(installConfig())
+	},
+}
+
+func init() {
+	addTargetFlags(uninstallCmd)
+	addAuditLogFlags(uninstallCmd)
+	rootCmd.AddCommand(uninstallCmd)
+}
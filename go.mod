@@ -3,6 +3,8 @@ module github.com/wilsonehusin/confiar
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/rs/zerolog v1.21.0
 	github.com/spf13/cobra v1.1.3
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,201 @@
+/*
+Copyright © 2021 Wilson Husin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package audit keeps an append-only record of certificates leaving or
+// entering a host, as JSON lines in a size-rotated file.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ActionDownload  = "download"
+	ActionIssue     = "issue"
+	ActionInstall   = "install"
+	ActionUninstall = "uninstall"
+)
+
+const (
+	ResultSuccess      = "success"
+	ResultFailure      = "failure"
+	ResultUnauthorized = "unauthorized"
+)
+
+type Event struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	Result      string    `json:"result"`
+	Client      string    `json:"client,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Serial      string    `json:"serial,omitempty"`
+	Names       []string  `json:"names,omitempty"`
+	IPs         []string  `json:"ips,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Target      string    `json:"target,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+type Logger struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	closed bool
+}
+
+var (
+	defaultMu     sync.Mutex
+	defaultLogger *Logger
+)
+
+func currentLogger() *Logger {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	return defaultLogger
+}
+
+// Open starts recording events from Record into path, rotating the file once
+// it grows beyond maxBytes and keeping maxBackups rotated files, or all of
+// them when maxBackups is 0.
+func Open(path string, maxBytes int64, maxBackups int) error {
+	l := &Logger{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxBackups: maxBackups,
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	defaultMu.Lock()
+	defaultLogger = l
+	defaultMu.Unlock()
+	log.Debug().Str("path", path).Int64("maxBytes", maxBytes).Int("maxBackups", maxBackups).Msg("audit log enabled")
+	return nil
+}
+
+// Close waits for an event being written and closes the audit log, it is
+// safe to call more than once
+func Close() error {
+	defaultMu.Lock()
+	l := defaultLogger
+	defaultLogger = nil
+	defaultMu.Unlock()
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	return l.file.Close()
+}
+
+// Record appends the event to the audit log, if one was opened. Failing to
+// record is logged rather than returned, as it should not fail the action.
+func Record(e Event) {
+	l := currentLogger()
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if err := l.write(e); err != nil {
+		log.Error().Err(err).Str("action", e.Action).Msg("unable to record audit event")
+	}
+}
+
+func (l *Logger) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("unable to open audit log: %w", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+func (l *Logger) write(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// recorded after the audit log was closed on exit
+	if l.closed {
+		return fmt.Errorf("audit log is closed")
+	}
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// rotate shifts path.N-1 to path.N down to path to path.1, dropping whatever
+// falls beyond maxBackups. Every backup is kept when maxBackups is 0.
+func (l *Logger) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	backups := l.maxBackups
+	if backups <= 0 {
+		backups = 1
+		for {
+			if _, err := os.Stat(backupPath(l.path, backups)); err != nil {
+				break
+			}
+			backups++
+		}
+	}
+	for i := backups - 1; i > 0; i-- {
+		if err := os.Rename(backupPath(l.path, i), backupPath(l.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.path, backupPath(l.path, 1)); err != nil {
+		return err
+	}
+	log.Debug().Str("path", l.path).Msg("rotated audit log")
+	return l.open()
+}
+
+func backupPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
@@ -0,0 +1,120 @@
+/*
+Copyright © 2021 Wilson Husin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func recordEvents(t *testing.T, logPath string, maxBackups int, count int) {
+	t.Helper()
+	// room for about two events per file
+	if err := Open(logPath, 300, maxBackups); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		Record(Event{Action: ActionDownload, Result: ResultSuccess, Client: fmt.Sprintf("10.0.0.%d", i)})
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotateKeepsAllBackups(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "audit.log")
+	recordEvents(t, logPath, 0, 10)
+
+	if _, err := os.Stat(backupPath(logPath, 4)); err != nil {
+		t.Error(err)
+	}
+	events, err := Query(logPath, &Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 10 {
+		t.Fatalf("expected every event to be kept, got %v", events)
+	}
+	for i, e := range events {
+		if want := fmt.Sprintf("10.0.0.%d", i); e.Client != want {
+			t.Errorf("event %d is from %s, want %s", i, e.Client, want)
+		}
+	}
+}
+
+func TestRotateWithBackups(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "audit.log")
+	recordEvents(t, logPath, 2, 10)
+
+	if _, err := os.Stat(backupPath(logPath, 2)); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(backupPath(logPath, 3)); !os.IsNotExist(err) {
+		t.Errorf("expected at most 2 backups, got %v", err)
+	}
+	events, err := Query(logPath, &Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].Time.Before(events[i-1].Time) {
+			t.Errorf("events out of order: %v", events)
+		}
+	}
+	if len(events) < 5 || events[len(events)-1].Client != "10.0.0.9" {
+		t.Errorf("expected the latest events to be kept, got %v", events)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "audit.log")
+	recordEvents(t, logPath, 1, 1)
+	if err := Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+// run with -race, handlers may still record while the command exits
+func TestRecordWhileClosing(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "audit.log")
+	if err := Open(logPath, 1024*1024, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				Record(Event{Action: ActionDownload, Result: ResultSuccess, Client: fmt.Sprintf("10.0.%d.%d", i, j)})
+			}
+		}(i)
+	}
+	if err := Close(); err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+
+	// whatever made it in before closing is intact
+	if _, err := Query(logPath, &Filter{}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright © 2021 Wilson Husin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type Filter struct {
+	Action      string
+	Client      string
+	Fingerprint string
+	Name        string
+	Since       time.Time
+}
+
+func (f *Filter) Match(e *Event) bool {
+	if f.Action != "" && e.Action != f.Action {
+		return false
+	}
+	if f.Client != "" && e.Client != f.Client {
+		return false
+	}
+	if f.Fingerprint != "" && !strings.HasPrefix(e.Fingerprint, strings.ToLower(f.Fingerprint)) {
+		return false
+	}
+	if f.Name != "" && !contains(e.Names, f.Name) {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Query reads events matching the filter from path and its rotated backups,
+// oldest first
+func Query(path string, filter *Filter) ([]Event, error) {
+	files := []string{}
+	for i := 1; ; i++ {
+		backup := backupPath(path, i)
+		if _, err := os.Stat(backup); err != nil {
+			break
+		}
+		files = append([]string{backup}, files...)
+	}
+	files = append(files, path)
+
+	events := []Event{}
+	for _, file := range files {
+		matched, err := queryFile(file, filter)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, matched...)
+	}
+	return events, nil
+}
+
+func queryFile(path string, filter *Filter) ([]Event, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	events := []Event{}
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: malformed audit event: %w", path, lineNum, err)
+		}
+		if filter.Match(&e) {
+			events = append(events, e)
+		}
+	}
+	return events, scanner.Err()
+}
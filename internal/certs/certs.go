@@ -0,0 +1,79 @@
+/*
+Copyright © 2021 Wilson Husin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+)
+
+// Fingerprint is the hex encoded SHA-256 digest of a DER encoded certificate
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// ParsePEM parses the first certificate in PEM encoded data
+func ParsePEM(data []byte) (*x509.Certificate, error) {
+	pemBlock, _ := pem.Decode(data)
+	if pemBlock == nil {
+		return nil, fmt.Errorf("failed to parse certificate PEM")
+	}
+	return x509.ParseCertificate(pemBlock.Bytes)
+}
+
+// BundleContains reports whether a PEM bundle has the DER encoded certificate
+func BundleContains(bundle []byte, der []byte) bool {
+	for {
+		var pemBlock *pem.Block
+		pemBlock, bundle = pem.Decode(bundle)
+		if pemBlock == nil {
+			return false
+		}
+		if pemBlock.Type == "CERTIFICATE" && bytes.Equal(pemBlock.Bytes, der) {
+			return true
+		}
+	}
+}
+
+// BundleWithout returns bundle without the PEM blocks of der, keeping
+// everything else as it is, and reports whether any was removed
+func BundleWithout(bundle []byte, der []byte) ([]byte, bool) {
+	kept := []byte{}
+	removed := false
+	for {
+		pemBlock, rest := pem.Decode(bundle)
+		if pemBlock == nil {
+			return append(kept, bundle...), removed
+		}
+		consumed := bundle[:len(bundle)-len(rest)]
+		if pemBlock.Type == "CERTIFICATE" && bytes.Equal(pemBlock.Bytes, der) {
+			// whatever precedes the block, such as comments, stays
+			if begin := bytes.Index(consumed, []byte("-----BEGIN")); begin >= 0 {
+				kept = append(kept, consumed[:begin]...)
+			}
+			removed = true
+		} else {
+			kept = append(kept, consumed...)
+		}
+		bundle = rest
+	}
+}
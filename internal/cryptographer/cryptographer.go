@@ -16,9 +16,24 @@ limitations under the License.
 
 package cryptographer
 
+import (
+	"crypto"
+	"crypto/x509"
+)
+
 const certFileName = "cert.pem"
 const keyFileName = "key.pem"
 
 type Cryptographer interface {
 	NewTLSSelfAuthority([]string, []string, string) error
+
+	// NewTLSCertificateRequest generates a private key and returns a DER encoded
+	// certificate signing request for it, the private key is kept until
+	// WriteTLSCertificate is called.
+	NewTLSCertificateRequest([]string, []string) ([]byte, error)
+	WriteTLSCertificate([]byte, string) error
+
+	// SignTLSCertificateRequest issues a leaf certificate for the DER encoded
+	// certificate signing request, signed by the given certificate authority.
+	SignTLSCertificateRequest([]byte, *x509.Certificate, crypto.Signer) ([]byte, error)
 }
@@ -17,6 +17,7 @@ limitations under the License.
 package cryptographer
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -69,6 +70,8 @@ func (g *GoStd) NewTLSSelfAuthority(names []string, ips []string, outDir string)
 
 	log.Info().Time("validFrom", validFrom).Time("validUntil", validUntil).Msg("certificate valid lifetime")
 
+	// client authentication is for certificates issued by serve, verifiers
+	// expect the authority to allow what it signs for
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
@@ -82,7 +85,7 @@ func (g *GoStd) NewTLSSelfAuthority(names []string, ips []string, outDir string)
 		NotBefore:             validFrom,  // ugh
 		NotAfter:              validUntil, // ugh x2
 		KeyUsage:              keyUsage,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
 		IsCA:                  true,
 	}
@@ -130,6 +133,128 @@ func (g *GoStd) NewTLSSelfAuthority(names []string, ips []string, outDir string)
 	return nil
 }
 
+func (g *GoStd) NewTLSCertificateRequest(names []string, ips []string) ([]byte, error) {
+	log.Info().Strs("names", names).Strs("ips", ips).Msg("creating certificate request")
+
+	priv, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate private key: %w", err)
+	}
+	g.priv = priv
+
+	template := x509.CertificateRequest{
+		DNSNames: names,
+	}
+	if len(names) > 0 {
+		template.Subject.CommonName = names[0]
+	}
+	for _, ip := range ips {
+		template.IPAddresses = append(template.IPAddresses, net.ParseIP(ip))
+	}
+
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &template, g.priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate request: %w", err)
+	}
+	return csrBytes, nil
+}
+
+func (g *GoStd) WriteTLSCertificate(derBytes []byte, outDir string) error {
+	if g.priv == nil {
+		return fmt.Errorf("no private key available, create a certificate request first")
+	}
+	g.derBytes = derBytes
+	g.outDir = outDir
+	if outDir != "" {
+		if err := os.MkdirAll(outDir, os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create outDir: %w", err)
+		}
+	}
+
+	if err := g.writeCertFile(); err != nil {
+		return err
+	}
+	log.Info().Str("filename", certFileName).Msg("wrote file")
+
+	if err := g.writeKeyFile(); err != nil {
+		return err
+	}
+	log.Info().Str("filename", keyFileName).Msg("wrote file")
+
+	return nil
+}
+
+func (g *GoStd) SignTLSCertificateRequest(csrBytes []byte, ca *x509.Certificate, caKey crypto.Signer) ([]byte, error) {
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate request: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request signature: %w", err)
+	}
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	validFrom := now.Add(-1 * time.Hour) // prevent issues from cross-machine time gap
+	validUntil := now.Add(365 * 24 * time.Hour)
+	if validUntil.After(ca.NotAfter) {
+		// no point outliving the authority
+		validUntil = ca.NotAfter
+	}
+
+	extKeyUsage := allowedExtKeyUsage(ca, x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth)
+	if len(extKeyUsage) == 0 {
+		return nil, fmt.Errorf("certificate authority is not allowed to sign TLS certificates")
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               csr.Subject,
+		NotBefore:             validFrom,
+		NotAfter:              validUntil,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           extKeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		DNSNames:              csr.DNSNames,
+		IPAddresses:           csr.IPAddresses,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, ca, csr.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+	log.Info().
+		Strs("names", csr.DNSNames).
+		Str("serial", serialNumber.Text(16)).
+		Time("validUntil", validUntil).
+		Msg("signed certificate")
+	return derBytes, nil
+}
+
+// allowedExtKeyUsage narrows wanted down to the usages ca may sign for, as
+// authorities generated by earlier versions only allow server authentication
+func allowedExtKeyUsage(ca *x509.Certificate, wanted ...x509.ExtKeyUsage) []x509.ExtKeyUsage {
+	if len(ca.ExtKeyUsage) == 0 && len(ca.UnknownExtKeyUsage) == 0 {
+		return wanted
+	}
+	allowed := []x509.ExtKeyUsage{}
+	for _, usage := range wanted {
+		for _, caUsage := range ca.ExtKeyUsage {
+			if caUsage == usage || caUsage == x509.ExtKeyUsageAny {
+				allowed = append(allowed, usage)
+				break
+			}
+		}
+	}
+	return allowed
+}
+
 func (g *GoStd) writeCertFile() error {
 	certFile, err := os.Create(path.Join(g.outDir, certFileName))
 	if err != nil {
@@ -0,0 +1,115 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cryptographer
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newAuthority(t *testing.T) (*GoStd, *x509.Certificate) {
+	t.Helper()
+	ca := &GoStd{}
+	if err := ca.NewTLSSelfAuthority([]string{"ca.corp"}, nil, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(ca.derBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, caCert
+}
+
+func issue(t *testing.T, ca *GoStd, caCert *x509.Certificate) *x509.Certificate {
+	t.Helper()
+	client := &GoStd{}
+	csrBytes, err := client.NewTLSCertificateRequest([]string{"client.corp"}, []string{"10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	derBytes, err := ca.SignTLSCertificateRequest(csrBytes, caCert, ca.priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+func verify(leaf *x509.Certificate, caCert *x509.Certificate, usage x509.ExtKeyUsage) error {
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	_, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:   "client.corp",
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{usage},
+	})
+	return err
+}
+
+func TestSignTLSCertificateRequest(t *testing.T) {
+	ca, caCert := newAuthority(t)
+	leaf := issue(t, ca, caCert)
+
+	for name, usage := range map[string]x509.ExtKeyUsage{
+		"server": x509.ExtKeyUsageServerAuth,
+		"client": x509.ExtKeyUsageClientAuth,
+	} {
+		if err := verify(leaf, caCert, usage); err != nil {
+			t.Errorf("%s authentication: %v", name, err)
+		}
+	}
+}
+
+// authorities generated before client authentication was allowed still issue
+// certificates which verify, for server authentication only
+func TestSignTLSCertificateRequestServerOnlyAuthority(t *testing.T) {
+	ca, generated := newAuthority(t)
+
+	template := *generated
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	template.NotAfter = time.Now().Add(time.Hour)
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &ca.priv.PublicKey, ca.priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf := issue(t, ca, caCert)
+	if len(leaf.ExtKeyUsage) != 1 || leaf.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Errorf("expected only server authentication, got %v", leaf.ExtKeyUsage)
+	}
+	if err := verify(leaf, caCert, x509.ExtKeyUsageServerAuth); err != nil {
+		t.Errorf("server authentication: %v", err)
+	}
+	if !leaf.NotAfter.Equal(caCert.NotAfter) {
+		t.Errorf("expected validity to end with the authority at %v, got %v", caCert.NotAfter, leaf.NotAfter)
+	}
+}
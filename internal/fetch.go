@@ -0,0 +1,235 @@
+/*
+Copyright © 2021 Wilson Husin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// no certificate (chain) we care about comes close to this
+	maxCertBytes = 1024 * 1024
+
+	fetchTimeout  = 30 * time.Second
+	fetchAttempts = 4
+)
+
+// fetchBackoff is the wait before the first retry, doubling with every one
+var fetchBackoff = time.Second
+
+var errCertTooLarge = fmt.Errorf("certificate exceeds %d bytes", maxCertBytes)
+
+type fetchedCert struct {
+	path string
+	etag string
+
+	// temporary files are local copies of a remote certificate
+	temporary bool
+
+	// notModified is set when the remote reports no change since etag, in
+	// which case there is no path
+	notModified bool
+}
+
+func (f *fetchedCert) cleanup() {
+	if !f.temporary {
+		return
+	}
+	log.Info().Str("certPath", f.path).Msg("removing cert from local path")
+	os.Remove(f.path)
+}
+
+// fetchCertificate makes certSrc available as a local PEM file, remote sources
+// are only downloaded when they no longer match etag. Supported sources are
+// http(s):// and file:// URLs, "-" for stdin, or a local path.
+func fetchCertificate(certSrc string, etag string) (*fetchedCert, error) {
+	switch {
+	case certSrc == "-":
+		log.Info().Msg("reading certificate from stdin")
+		data, err := readLimited(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read certificate from stdin: %w", err)
+		}
+		pemData, err := normalizeCertificate(data)
+		if err != nil {
+			return nil, fmt.Errorf("stdin: %w", err)
+		}
+		return writeTempCert(pemData, "")
+	case strings.HasPrefix(certSrc, "http://"), strings.HasPrefix(certSrc, "https://"):
+		return fetchRemote(certSrc, etag)
+	case strings.HasPrefix(certSrc, "file://"):
+		srcURL, err := url.Parse(certSrc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate source: %w", err)
+		}
+		return fetchLocal(srcURL.Path)
+	default:
+		return fetchLocal(certSrc)
+	}
+}
+
+func fetchLocal(certPath string) (*fetchedCert, error) {
+	file, err := os.Open(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open certificate: %w", err)
+	}
+	defer file.Close()
+
+	data, err := readLimited(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read certificate: %w", err)
+	}
+	pemData, err := normalizeCertificate(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", certPath, err)
+	}
+	if !bytes.Equal(pemData, data) {
+		// targets only understand PEM, so DER files get a converted copy
+		return writeTempCert(pemData, "")
+	}
+	return &fetchedCert{path: certPath}, nil
+}
+
+func fetchRemote(certSrc string, etag string) (*fetchedCert, error) {
+	if etag == "" {
+		log.Info().Str("certSrc", certSrc).Msg("downloading to local path")
+	} else {
+		log.Debug().Str("certSrc", certSrc).Str("etag", etag).Msg("checking remote for changes")
+	}
+
+	client := &http.Client{Timeout: fetchTimeout}
+	backoff := fetchBackoff
+	var lastErr error
+	for attempt := 1; attempt <= fetchAttempts; attempt++ {
+		if attempt > 1 {
+			log.Warn().Err(lastErr).Int("attempt", attempt).Dur("backoff", backoff).Msg("retrying certificate download")
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		fetched, retry, err := fetchRemoteOnce(client, certSrc, etag)
+		if err == nil {
+			return fetched, nil
+		}
+		lastErr = err
+		if !retry {
+			break
+		}
+	}
+	return nil, fmt.Errorf("unable to get certificate from remote: %w", lastErr)
+}
+
+// fetchRemoteOnce reports whether a failed attempt is worth retrying
+func fetchRemoteOnce(client *http.Client, certSrc string, etag string) (*fetchedCert, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, certSrc, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("User-Agent", "confiar/"+Version)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return &fetchedCert{etag: etag, notModified: true}, false, nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= http.StatusInternalServerError:
+		return nil, true, fmt.Errorf("remote responded with %s", resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, false, fmt.Errorf("remote responded with %s", resp.Status)
+	}
+
+	data, err := readLimited(resp.Body)
+	if err != nil {
+		return nil, !errors.Is(err, errCertTooLarge), err
+	}
+	pemData, err := normalizeCertificate(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %w", certSrc, err)
+	}
+	fetched, err := writeTempCert(pemData, resp.Header.Get("ETag"))
+	return fetched, false, err
+}
+
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxCertBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxCertBytes {
+		return nil, errCertTooLarge
+	}
+	return data, nil
+}
+
+// normalizeCertificate returns data as PEM, after checking that it is (or
+// starts with) a parseable certificate in either PEM or DER encoding
+func normalizeCertificate(data []byte) ([]byte, error) {
+	if pemBlock, _ := pem.Decode(data); pemBlock != nil {
+		if pemBlock.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("expected PEM block of type CERTIFICATE, got %s", pemBlock.Type)
+		}
+		if _, err := x509.ParseCertificate(pemBlock.Bytes); err != nil {
+			return nil, fmt.Errorf("invalid certificate: %w", err)
+		}
+		return data, nil
+	}
+	if _, err := x509.ParseCertificate(data); err != nil {
+		return nil, fmt.Errorf("content is neither a PEM nor DER encoded certificate")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: data}), nil
+}
+
+func writeTempCert(pemData []byte, etag string) (*fetchedCert, error) {
+	tempCert, err := ioutil.TempFile(os.TempDir(), "confiar-cert-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create local copy of certificate: %w", err)
+	}
+	if _, err := tempCert.Write(pemData); err != nil {
+		tempCert.Close()
+		os.Remove(tempCert.Name())
+		return nil, fmt.Errorf("unable to write certificate to local: %w", err)
+	}
+	if err := tempCert.Close(); err != nil {
+		os.Remove(tempCert.Name())
+		return nil, fmt.Errorf("unable to write certificate to local: %w", err)
+	}
+	return &fetchedCert{
+		path:      tempCert.Name(),
+		etag:      etag,
+		temporary: true,
+	}, nil
+}
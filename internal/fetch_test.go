@@ -0,0 +1,189 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testCertificatePEM(t *testing.T) []byte {
+	t.Helper()
+	certPath, _ := writeAuthority(t, t.TempDir(), "ca.corp")
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// remote answers with responses in order, repeating the last one
+func remote(t *testing.T, responses ...func(w http.ResponseWriter, r *http.Request)) (*httptest.Server, *int32) {
+	t.Helper()
+	previous := fetchBackoff
+	fetchBackoff = time.Millisecond
+	t.Cleanup(func() { fetchBackoff = previous })
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit := int(atomic.AddInt32(&hits, 1))
+		if hit > len(responses) {
+			hit = len(responses)
+		}
+		responses[hit-1](w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &hits
+}
+
+func respond(status int, body []byte) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write(body)
+	}
+}
+
+func readFetched(t *testing.T, fetched *fetchedCert) []byte {
+	t.Helper()
+	t.Cleanup(fetched.cleanup)
+	if !fetched.temporary {
+		t.Error("remote certificate is not a temporary copy")
+	}
+	data, err := os.ReadFile(fetched.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestFetchRemote(t *testing.T) {
+	pemData := testCertificatePEM(t)
+	block, _ := pem.Decode(pemData)
+
+	cases := []struct {
+		name      string
+		responses []func(w http.ResponseWriter, r *http.Request)
+		hits      int32
+		err       string
+	}{
+		{
+			name:      "PEM",
+			responses: []func(w http.ResponseWriter, r *http.Request){respond(http.StatusOK, pemData)},
+			hits:      1,
+		},
+		{
+			name:      "DER",
+			responses: []func(w http.ResponseWriter, r *http.Request){respond(http.StatusOK, block.Bytes)},
+			hits:      1,
+		},
+		{
+			name: "retried on 503",
+			responses: []func(w http.ResponseWriter, r *http.Request){
+				respond(http.StatusServiceUnavailable, nil),
+				respond(http.StatusServiceUnavailable, nil),
+				respond(http.StatusOK, pemData),
+			},
+			hits: 3,
+		},
+		{
+			name:      "gives up on 503",
+			responses: []func(w http.ResponseWriter, r *http.Request){respond(http.StatusServiceUnavailable, nil)},
+			hits:      fetchAttempts,
+			err:       "503 Service Unavailable",
+		},
+		{
+			name:      "not retried on 404",
+			responses: []func(w http.ResponseWriter, r *http.Request){respond(http.StatusNotFound, nil)},
+			hits:      1,
+			err:       "404 Not Found",
+		},
+		{
+			name:      "too large",
+			responses: []func(w http.ResponseWriter, r *http.Request){respond(http.StatusOK, bytes.Repeat(pemData, maxCertBytes/len(pemData)+1))},
+			hits:      1,
+			err:       "certificate exceeds",
+		},
+		{
+			name:      "not a certificate",
+			responses: []func(w http.ResponseWriter, r *http.Request){respond(http.StatusOK, []byte("<html>login</html>"))},
+			hits:      1,
+			err:       "neither a PEM nor DER encoded certificate",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server, hits := remote(t, c.responses...)
+			fetched, err := fetchCertificate(server.URL, "")
+			if got := atomic.LoadInt32(hits); got != c.hits {
+				t.Errorf("got %d requests, want %d", got, c.hits)
+			}
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Errorf("got error %v, want one containing %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// DER is converted, so targets always get PEM
+			if data := readFetched(t, fetched); !bytes.Equal(data, pemData) {
+				t.Errorf("got\n%s\nwant\n%s", data, pemData)
+			}
+		})
+	}
+}
+
+func TestFetchRemoteNotModified(t *testing.T) {
+	pemData := testCertificatePEM(t)
+	const etag = `"v1"`
+	server, hits := remote(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write(pemData)
+	})
+
+	fetched, err := fetchCertificate(server.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readFetched(t, fetched)
+	if fetched.etag != etag {
+		t.Errorf("got etag %q, want %q", fetched.etag, etag)
+	}
+
+	unchanged, err := fetchCertificate(server.URL, fetched.etag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unchanged.notModified || unchanged.path != "" || unchanged.etag != etag {
+		t.Errorf("expected an unchanged certificate, got %+v", unchanged)
+	}
+	if got := atomic.LoadInt32(hits); got != 2 {
+		t.Errorf("got %d requests, want 2", got)
+	}
+}
@@ -0,0 +1,629 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/wilsonehusin/confiar/internal/certs"
+	"github.com/wilsonehusin/confiar/internal/oci"
+	"github.com/wilsonehusin/confiar/internal/target"
+)
+
+type ImageConfig struct {
+	// Image is an OCI image layout directory or tarball, optionally followed
+	// by :tag to pick one of several images
+	Image   string
+	CertSrc string
+
+	// Tag stores the result under a new tag, leaving the original image as
+	// it was
+	Tag string
+}
+
+// AddCAToImage appends a layer to the image which adds the certificate to the
+// image's system trust store, without running anything inside the image.
+func AddCAToImage(config *ImageConfig) error {
+	fetched, err := fetchCertificate(config.CertSrc, "")
+	if err != nil {
+		return err
+	}
+	defer fetched.cleanup()
+
+	imagePath, tag := splitImageRef(config.Image)
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return err
+	}
+
+	layoutDir := imagePath
+	if !info.IsDir() {
+		if layoutDir, err = os.MkdirTemp("", "confiar-image-"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(layoutDir)
+		log.Debug().Str("archive", imagePath).Str("dir", layoutDir).Msg("extracting image archive")
+		if err := extractArchive(imagePath, layoutDir); err != nil {
+			return fmt.Errorf("unable to extract %s: %w", imagePath, err)
+		}
+	}
+
+	layout, err := oci.OpenLayout(layoutDir)
+	if err != nil {
+		return err
+	}
+	index, err := layout.ReadIndex()
+	if err != nil {
+		return err
+	}
+	i, err := findImage(index, tag)
+	if err != nil {
+		return err
+	}
+
+	rewritten := map[string]rewrittenImage{}
+	desc, err := addCAToDescriptor(layout, index.Manifests[i], fetched.path, rewritten)
+	if err != nil {
+		return err
+	}
+	if desc.Digest == index.Manifests[i].Digest {
+		log.Info().Str("image", config.Image).Msg("image already trusts the certificate")
+		return nil
+	}
+
+	if config.Tag == "" {
+		index.Manifests[i] = desc
+	} else {
+		desc.Annotations = copyAnnotations(desc.Annotations)
+		desc.Annotations[oci.AnnotationRefName] = config.Tag
+		if name, ok := desc.Annotations[oci.AnnotationImageName]; ok {
+			desc.Annotations[oci.AnnotationImageName] = retag(name, config.Tag)
+		}
+		if existing, err := findImage(index, config.Tag); err == nil {
+			index.Manifests[existing] = desc
+		} else {
+			index.Manifests = append(index.Manifests, desc)
+		}
+	}
+	if err := layout.WriteIndex(index); err != nil {
+		return err
+	}
+	if err := updateDockerSave(layout, rewritten, config.Tag); err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		log.Debug().Str("archive", imagePath).Msg("writing image archive")
+		if err := writeArchive(layoutDir, imagePath); err != nil {
+			return fmt.Errorf("unable to write %s: %w", imagePath, err)
+		}
+	}
+	log.Info().Str("image", imagePath).Str("tag", desc.Annotations[oci.AnnotationRefName]).Str("digest", desc.Digest).Msg("certificate added to image")
+	return nil
+}
+
+// splitImageRef separates the tag from path:tag, as long as path:tag is not
+// itself an existing path
+func splitImageRef(ref string) (string, string) {
+	if _, err := os.Stat(ref); err == nil {
+		return ref, ""
+	}
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || strings.Contains(ref[i:], "/") {
+		return ref, ""
+	}
+	return ref[:i], ref[i+1:]
+}
+
+func findImage(index *oci.Index, tag string) (int, error) {
+	if tag == "" {
+		if len(index.Manifests) != 1 {
+			return 0, fmt.Errorf("image layout holds %d images, pick one with :tag", len(index.Manifests))
+		}
+		return 0, nil
+	}
+	for i, desc := range index.Manifests {
+		if desc.Annotations[oci.AnnotationRefName] == tag {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no image tagged %s", tag)
+}
+
+func copyAnnotations(annotations map[string]string) map[string]string {
+	copied := map[string]string{}
+	for key, value := range annotations {
+		copied[key] = value
+	}
+	return copied
+}
+
+// rewrittenImage is what addCAToManifest changed about an image, keyed by its
+// previous config digest
+type rewrittenImage struct {
+	config string
+	layer  string
+}
+
+// addCAToDescriptor returns the descriptor of the updated image, which is
+// desc itself when nothing changed. Every platform of multi-platform images
+// gets its own layer.
+func addCAToDescriptor(layout *oci.Layout, desc oci.Descriptor, certPath string, rewritten map[string]rewrittenImage) (oci.Descriptor, error) {
+	switch {
+	case desc.IsIndex():
+		index := &oci.Index{}
+		if err := layout.ReadJSON(desc, index); err != nil {
+			return desc, err
+		}
+		changed := false
+		for i, manifest := range index.Manifests {
+			// attestations pushed alongside images by BuildKit are not images
+			if bytes.Contains(manifest.Platform, []byte(`"unknown"`)) {
+				continue
+			}
+			updated, err := addCAToDescriptor(layout, manifest, certPath, rewritten)
+			if err != nil {
+				return desc, err
+			}
+			if updated.Digest != manifest.Digest {
+				index.Manifests[i] = updated
+				changed = true
+			}
+		}
+		if !changed {
+			return desc, nil
+		}
+		return updateDescriptor(layout, desc, index)
+	case desc.IsManifest():
+		return addCAToManifest(layout, desc, certPath, rewritten)
+	default:
+		return desc, fmt.Errorf("unsupported media type %s", desc.MediaType)
+	}
+}
+
+// updateDescriptor stores v in place of what desc points to, keeping the
+// rest of desc such as platform and annotations
+func updateDescriptor(layout *oci.Layout, desc oci.Descriptor, v interface{}) (oci.Descriptor, error) {
+	written, err := layout.WriteJSON(desc.MediaType, v)
+	if err != nil {
+		return desc, err
+	}
+	desc.Digest = written.Digest
+	desc.Size = written.Size
+	return desc, nil
+}
+
+func addCAToManifest(layout *oci.Layout, desc oci.Descriptor, certPath string, rewritten map[string]rewrittenImage) (oci.Descriptor, error) {
+	manifest := &oci.Manifest{}
+	if err := layout.ReadJSON(desc, manifest); err != nil {
+		return desc, err
+	}
+	// the config is kept as a map, there is more to it than confiar needs
+	imageConfig := map[string]interface{}{}
+	if err := layout.ReadJSON(manifest.Config, &imageConfig); err != nil {
+		return desc, err
+	}
+
+	certBytes, err := os.ReadFile(certPath)
+	if err != nil {
+		return desc, err
+	}
+	certData, err := certs.ParsePEM(certBytes)
+	if err != nil {
+		return desc, err
+	}
+	files, err := trustFilesFor(layout, manifest, certPath, certData)
+	if err != nil {
+		return desc, err
+	}
+	if len(files) == 0 {
+		return desc, nil
+	}
+
+	// dated after the certificate, so that the same certificate always
+	// results in the same layer
+	layerData, diffID, err := oci.NewLayer(files, certData.NotBefore.UTC())
+	if err != nil {
+		return desc, err
+	}
+	layerType := oci.MediaTypeImageLayerGz
+	if manifest.MediaType == oci.MediaTypeDockerManifest {
+		layerType = oci.MediaTypeDockerLayerGz
+	}
+	layer, err := layout.WriteBlob(layerType, layerData)
+	if err != nil {
+		return desc, err
+	}
+	manifest.Layers = append(manifest.Layers, layer)
+
+	rootfs, ok := imageConfig["rootfs"].(map[string]interface{})
+	if !ok {
+		return desc, fmt.Errorf("image config %s has no rootfs", manifest.Config.Digest)
+	}
+	diffIDs, _ := rootfs["diff_ids"].([]interface{})
+	rootfs["diff_ids"] = append(diffIDs, diffID)
+	history, _ := imageConfig["history"].([]interface{})
+	imageConfig["history"] = append(history, map[string]interface{}{
+		"created":    certData.NotBefore.UTC().Format(time.RFC3339),
+		"created_by": "confiar image add-ca",
+		"comment":    "trust certificate " + certs.Fingerprint(certData.Raw),
+	})
+	previousConfig := manifest.Config.Digest
+	if manifest.Config, err = updateDescriptor(layout, manifest.Config, imageConfig); err != nil {
+		return desc, err
+	}
+	rewritten[previousConfig] = rewrittenImage{config: manifest.Config.Digest, layer: layer.Digest}
+
+	log.Info().Str("layer", layer.Digest).Strs("files", sortedKeys(files)).Msg("added layer")
+	return updateDescriptor(layout, desc, manifest)
+}
+
+// updateDockerSave carries the rewritten images over to manifest.json and
+// repositories of docker save, which docker load goes by
+func updateDockerSave(layout *oci.Layout, rewritten map[string]rewrittenImage, tag string) error {
+	images, err := layout.ReadDockerManifest()
+	if err != nil || images == nil {
+		return err
+	}
+	repositories, err := layout.ReadRepositories()
+	if err != nil {
+		return err
+	}
+
+	byConfig := map[string]rewrittenImage{}
+	for previous, image := range rewritten {
+		byConfig[oci.BlobName(previous)] = image
+	}
+	for i := range images {
+		image, ok := byConfig[images[i].Config]
+		if !ok {
+			continue
+		}
+		updated := images[i]
+		updated.Config = oci.BlobName(image.config)
+		updated.Layers = append(append([]string{}, updated.Layers...), oci.BlobName(image.layer))
+		if tag == "" {
+			images[i] = updated
+		} else {
+			updated.RepoTags = []string{}
+			for _, repoTag := range images[i].RepoTags {
+				updated.RepoTags = append(updated.RepoTags, retag(repoTag, tag))
+			}
+			images = untag(images, updated.RepoTags)
+			images = append(images, updated)
+		}
+		for _, repoTag := range updated.RepoTags {
+			repo, repoTagName := oci.SplitRepoTag(repoTag)
+			if repositories == nil || repoTagName == "" {
+				continue
+			}
+			if repositories[repo] == nil {
+				repositories[repo] = map[string]string{}
+			}
+			repositories[repo][repoTagName] = strings.TrimPrefix(image.layer, "sha256:")
+		}
+	}
+
+	log.Debug().Str("dir", layout.Dir).Msg("updating docker save manifest.json")
+	if err := layout.WriteDockerManifest(images); err != nil {
+		return err
+	}
+	if repositories != nil {
+		return layout.WriteRepositories(repositories)
+	}
+	return nil
+}
+
+// retag replaces the tag of an image name, dropping any digest
+func retag(name string, tag string) string {
+	repo, _ := oci.SplitRepoTag(strings.SplitN(name, "@", 2)[0])
+	return repo + ":" + tag
+}
+
+// untag drops repoTags from images, as they are about to name another one
+func untag(images []oci.DockerImage, repoTags []string) []oci.DockerImage {
+	taken := map[string]bool{}
+	for _, repoTag := range repoTags {
+		taken[repoTag] = true
+	}
+	for i := range images {
+		kept := []string{}
+		for _, repoTag := range images[i].RepoTags {
+			if !taken[repoTag] {
+				kept = append(kept, repoTag)
+			}
+		}
+		images[i].RepoTags = kept
+	}
+	return images
+}
+
+// trustFilesFor installs the certificate into a scratch root holding only
+// what the system target looks at in the image, and returns every file that
+// ended up different, keyed by path in the image
+func trustFilesFor(layout *oci.Layout, manifest *oci.Manifest, certPath string, certData *x509.Certificate) (map[string][]byte, error) {
+	wanted := map[string]bool{}
+	for _, name := range target.SystemFiles() {
+		wanted[name] = true
+	}
+	filesystem := oci.NewFilesystem(func(name string) bool { return wanted[name] })
+	for _, layer := range manifest.Layers {
+		blob, err := layout.OpenBlob(layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		err = filesystem.Apply(blob)
+		blob.Close()
+		if err != nil {
+			return nil, fmt.Errorf("layer %s: %w", layer.Digest, err)
+		}
+	}
+
+	root, err := os.MkdirTemp("", "confiar-root-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(root)
+
+	original := map[string][]byte{}
+	for name := range wanted {
+		data, err := filesystem.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		if certs.BundleContains(data, certData.Raw) {
+			log.Debug().Str("bundle", name).Msg("certificate already in image bundle")
+			return nil, nil
+		}
+		original[name] = data
+		fullpath := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(fullpath), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(fullpath, data, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	system := &target.System{
+		CertPath: certPath,
+		Root:     root,
+		Runner:   &target.ExecRunner{Root: root, SkipCommands: true},
+	}
+	if err := system.Install(); err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{}
+	err = filepath.Walk(root, func(fullpath string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		name := "/" + filepath.ToSlash(strings.TrimPrefix(fullpath, root+string(filepath.Separator)))
+		data, err := os.ReadFile(fullpath)
+		if err != nil {
+			return err
+		}
+		if before, ok := original[name]; !ok || !bytes.Equal(before, data) {
+			files[name] = data
+		}
+		return nil
+	})
+	return files, err
+}
+
+func sortedKeys(files map[string][]byte) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// extractArchive unpacks an image archive into dir, keeping symbolic and hard
+// links. Entries which would end up outside of dir are refused.
+func extractArchive(archivePath string, dir string) error {
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fullpath, err := archiveEntryPath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if fullpath == dir {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(fullpath), 0755); err != nil {
+			return err
+		}
+		// earlier links may have taken the entry elsewhere
+		parent, err := filepath.EvalSymlinks(filepath.Dir(fullpath))
+		if err != nil {
+			return err
+		}
+		if !withinDir(dir, parent) {
+			return fmt.Errorf("archive entry %s leads outside of the image", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(fullpath, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			file, err := os.OpenFile(fullpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, tr)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if !symlinkWithin(dir, parent, hdr.Linkname) {
+				return fmt.Errorf("archive entry %s links to %s, outside of the image", hdr.Name, hdr.Linkname)
+			}
+			if err := os.Remove(fullpath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, fullpath); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			linkpath, err := archiveEntryPath(dir, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.Remove(fullpath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Link(linkpath, fullpath); err != nil {
+				return err
+			}
+		default:
+			log.Debug().Str("name", hdr.Name).Msg("skipping unexpected archive entry")
+		}
+	}
+}
+
+// archiveEntryPath places an archive entry in dir, leading slashes are
+// ignored but climbing out of dir is not
+func archiveEntryPath(dir string, name string) (string, error) {
+	fullpath := filepath.Join(dir, strings.TrimLeft(filepath.FromSlash(name), string(filepath.Separator)))
+	if !withinDir(dir, fullpath) {
+		return "", fmt.Errorf("archive entry %s leads outside of the image", name)
+	}
+	return fullpath, nil
+}
+
+// symlinkWithin reports whether a link in parent, which has no symbolic links
+// left in it, to linkname stays within dir. Only leading .. are allowed, as
+// the links they would follow otherwise are not known yet.
+func symlinkWithin(dir string, parent string, linkname string) bool {
+	if filepath.IsAbs(linkname) {
+		return false
+	}
+	climbing := true
+	for _, element := range strings.Split(filepath.ToSlash(linkname), "/") {
+		switch {
+		case element == ".." && climbing:
+		case element == ".." || element == ".":
+			return false
+		default:
+			climbing = false
+		}
+	}
+	return withinDir(dir, filepath.Join(parent, linkname))
+}
+
+func withinDir(dir string, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// writeArchive packs dir into archivePath, replacing it only once complete
+func writeArchive(dir string, archivePath string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(archivePath), "."+filepath.Base(archivePath)+".confiar-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	tw := tar.NewWriter(tmp)
+	err = filepath.Walk(dir, func(fullpath string, info os.FileInfo, err error) error {
+		if err != nil || fullpath == dir {
+			return err
+		}
+		name, err := filepath.Rel(dir, fullpath)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(fullpath); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(fullpath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(archivePath); err == nil {
+		if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), archivePath)
+}
@@ -0,0 +1,440 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wilsonehusin/confiar/internal/certs"
+	"github.com/wilsonehusin/confiar/internal/oci"
+)
+
+const imageAnchor = "/usr/local/share/ca-certificates/confiar-ca.corp.crt"
+const imageBundle = "/etc/ssl/certs/ca-certificates.crt"
+
+// testImage is an alpine-like image of a single layer, without
+// update-ca-certificates so that the bundle is appended to
+type testImage struct {
+	layout   *oci.Layout
+	manifest oci.Descriptor
+	config   oci.Descriptor
+	layer    oci.Descriptor
+	systemCA []byte
+}
+
+func writeTestImage(t *testing.T, dir string) *testImage {
+	t.Helper()
+	image := &testImage{layout: &oci.Layout{Dir: dir}, systemCA: testCertificatePEM(t)}
+	if err := os.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	layerData, diffID, err := oci.NewLayer(map[string][]byte{
+		"/etc/os-release": []byte("NAME=\"Alpine Linux\"\nID=alpine\n"),
+		imageBundle:       image.systemCA,
+	}, time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.layer, err = image.layout.WriteBlob(oci.MediaTypeImageLayerGz, layerData); err != nil {
+		t.Fatal(err)
+	}
+	if image.config, err = image.layout.WriteJSON("application/vnd.oci.image.config.v1+json", map[string]interface{}{
+		"architecture": "arm64",
+		"os":           "linux",
+		"config":       map[string]interface{}{"Cmd": []string{"/bin/sh"}},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{diffID}},
+		"history":      []map[string]string{{"created_by": "ADD rootfs.tar.gz /"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if image.manifest, err = image.layout.WriteJSON(oci.MediaTypeImageManifest, &oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     oci.MediaTypeImageManifest,
+		Config:        image.config,
+		Layers:        []oci.Descriptor{image.layer},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	image.manifest.Annotations = map[string]string{
+		oci.AnnotationRefName:   "latest",
+		oci.AnnotationImageName: "docker.io/library/base:latest",
+	}
+	if err := image.layout.WriteIndex(&oci.Index{SchemaVersion: 2, Manifests: []oci.Descriptor{image.manifest}}); err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+// writeDockerSave adds what docker save writes next to the OCI layout
+func (i *testImage) writeDockerSave(t *testing.T) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(i.layout.Dir, "manifest.json"), []byte(`[{"Config":"`+oci.BlobName(i.config.Digest)+
+		`","RepoTags":["base:latest"],"Layers":["`+oci.BlobName(i.layer.Digest)+`"],"LayerSources":{}}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repositories := map[string]map[string]string{"base": {"latest": strings.TrimPrefix(i.layer.Digest, "sha256:")}}
+	if err := i.layout.WriteRepositories(repositories); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readIndex(t *testing.T, layout *oci.Layout) *oci.Index {
+	t.Helper()
+	index, err := layout.ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return index
+}
+
+// layerFiles returns the regular files of a layer and its diff_id
+func layerFiles(t *testing.T, layout *oci.Layout, digest string) (map[string][]byte, string) {
+	t.Helper()
+	data, err := layout.ReadBlob(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(bytes.NewReader(uncompressed))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, oci.Digest(uncompressed)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if files["/"+strings.TrimPrefix(hdr.Name, "/")], err = io.ReadAll(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkTrusted verifies the image desc points to has the base layer plus one
+// adding the certificate, described in its config
+func checkTrusted(t *testing.T, image *testImage, desc oci.Descriptor, certPEM []byte) *oci.Manifest {
+	t.Helper()
+	manifest := &oci.Manifest{}
+	if err := image.layout.ReadJSON(desc, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 2 || manifest.Layers[0].Digest != image.layer.Digest {
+		t.Fatalf("expected the base layer and one more, got %+v", manifest.Layers)
+	}
+
+	files, diffID := layerFiles(t, image.layout, manifest.Layers[1].Digest)
+	if names := sortedKeys(files); !reflect.DeepEqual(names, []string{imageBundle, imageAnchor}) {
+		t.Errorf("got layer files %q", names)
+	}
+	if !bytes.Equal(files[imageAnchor], certPEM) {
+		t.Errorf("anchor does not hold the certificate")
+	}
+	certData, err := certs.ParsePEM(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	systemData, err := certs.ParsePEM(image.systemCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !certs.BundleContains(files[imageBundle], certData.Raw) || !certs.BundleContains(files[imageBundle], systemData.Raw) {
+		t.Errorf("bundle does not hold both certificates:\n%s", files[imageBundle])
+	}
+
+	config := struct {
+		Architecture string
+		Rootfs       struct {
+			DiffIDs []string `json:"diff_ids"`
+		}
+		History []map[string]interface{}
+	}{}
+	if err := image.layout.ReadJSON(manifest.Config, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Architecture != "arm64" {
+		t.Errorf("config lost its architecture: %+v", config)
+	}
+	if len(config.Rootfs.DiffIDs) != 2 || config.Rootfs.DiffIDs[1] != diffID {
+		t.Errorf("got diff_ids %q, want the base one and %s", config.Rootfs.DiffIDs, diffID)
+	}
+	if len(config.History) != 2 || config.History[1]["created_by"] != "confiar image add-ca" {
+		t.Errorf("got history %v", config.History)
+	}
+	return manifest
+}
+
+func TestAddCAToImage(t *testing.T) {
+	dir := t.TempDir()
+	image := writeTestImage(t, dir)
+	certPath, _ := writeAuthority(t, t.TempDir(), "ca.corp")
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddCAToImage(&ImageConfig{Image: dir, CertSrc: certPath}); err != nil {
+		t.Fatal(err)
+	}
+	index := readIndex(t, image.layout)
+	if len(index.Manifests) != 1 || index.Manifests[0].Digest == image.manifest.Digest {
+		t.Fatalf("expected the image to be replaced, got %+v", index.Manifests)
+	}
+	if !reflect.DeepEqual(index.Manifests[0].Annotations, image.manifest.Annotations) {
+		t.Errorf("got annotations %v", index.Manifests[0].Annotations)
+	}
+	checkTrusted(t, image, index.Manifests[0], certPEM)
+
+	before, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddCAToImage(&ImageConfig{Image: dir + ":latest", CertSrc: certPath}); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := os.ReadFile(filepath.Join(dir, "index.json")); err != nil || !bytes.Equal(before, after) {
+		t.Errorf("adding the certificate again changed index.json to %s (%v)", after, err)
+	}
+}
+
+func TestAddCAToImageTag(t *testing.T) {
+	dir := t.TempDir()
+	image := writeTestImage(t, dir)
+	certPath, _ := writeAuthority(t, t.TempDir(), "ca.corp")
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second time replaces the tagged image with an identical one
+	for i := 0; i < 2; i++ {
+		if err := AddCAToImage(&ImageConfig{Image: dir + ":latest", CertSrc: certPath, Tag: "trusted"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index := readIndex(t, image.layout)
+	if len(index.Manifests) != 2 {
+		t.Fatalf("expected the original and the tagged image, got %+v", index.Manifests)
+	}
+	if !reflect.DeepEqual(index.Manifests[0], image.manifest) {
+		t.Errorf("original image changed to %+v", index.Manifests[0])
+	}
+	tagged := index.Manifests[1]
+	want := map[string]string{
+		oci.AnnotationRefName:   "trusted",
+		oci.AnnotationImageName: "docker.io/library/base:trusted",
+	}
+	if !reflect.DeepEqual(tagged.Annotations, want) {
+		t.Errorf("got annotations %v, want %v", tagged.Annotations, want)
+	}
+	checkTrusted(t, image, tagged, certPEM)
+}
+
+func TestAddCAToImageDockerSave(t *testing.T) {
+	for _, tag := range []string{"", "trusted"} {
+		t.Run("tag "+tag, func(t *testing.T) {
+			dir := t.TempDir()
+			image := writeTestImage(t, dir)
+			image.writeDockerSave(t)
+			if err := os.Symlink("index.json", filepath.Join(dir, "index-link.json")); err != nil {
+				t.Fatal(err)
+			}
+			archivePath := filepath.Join(t.TempDir(), "base.tar")
+			if err := writeArchive(dir, archivePath); err != nil {
+				t.Fatal(err)
+			}
+			certPath, _ := writeAuthority(t, t.TempDir(), "ca.corp")
+			certPEM, err := os.ReadFile(certPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := AddCAToImage(&ImageConfig{Image: archivePath, CertSrc: certPath, Tag: tag}); err != nil {
+				t.Fatal(err)
+			}
+			extracted := t.TempDir()
+			if err := extractArchive(archivePath, extracted); err != nil {
+				t.Fatal(err)
+			}
+			image.layout = &oci.Layout{Dir: extracted}
+			if link, err := os.Readlink(filepath.Join(extracted, "index-link.json")); err != nil || link != "index.json" {
+				t.Errorf("symbolic link was not kept: %q (%v)", link, err)
+			}
+
+			index := readIndex(t, image.layout)
+			trusted := checkTrusted(t, image, index.Manifests[len(index.Manifests)-1], certPEM)
+			images, err := image.layout.ReadDockerManifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			repositories, err := image.layout.ReadRepositories()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := []oci.DockerImage{{
+				Config:   oci.BlobName(trusted.Config.Digest),
+				RepoTags: []string{"base:latest"},
+				Layers:   []string{oci.BlobName(image.layer.Digest), oci.BlobName(trusted.Layers[1].Digest)},
+				Extra:    map[string]json.RawMessage{"LayerSources": json.RawMessage("{}")},
+			}}
+			wantRepositories := map[string]map[string]string{"base": {"latest": strings.TrimPrefix(trusted.Layers[1].Digest, "sha256:")}}
+			if tag != "" {
+				original := oci.DockerImage{
+					Config:   oci.BlobName(image.config.Digest),
+					RepoTags: []string{"base:latest"},
+					Layers:   []string{oci.BlobName(image.layer.Digest)},
+					Extra:    want[0].Extra,
+				}
+				want[0].RepoTags = []string{"base:trusted"}
+				want = append([]oci.DockerImage{original}, want...)
+				wantRepositories["base"]["latest"] = strings.TrimPrefix(image.layer.Digest, "sha256:")
+				wantRepositories["base"]["trusted"] = strings.TrimPrefix(trusted.Layers[1].Digest, "sha256:")
+			}
+			if !reflect.DeepEqual(images, want) {
+				t.Errorf("got manifest.json\n%+v\nwant\n%+v", images, want)
+			}
+			if !reflect.DeepEqual(repositories, wantRepositories) {
+				t.Errorf("got repositories %v, want %v", repositories, wantRepositories)
+			}
+			for _, image := range images {
+				for _, name := range append([]string{image.Config}, image.Layers...) {
+					if _, err := os.Stat(filepath.Join(extracted, name)); err != nil {
+						t.Errorf("manifest.json refers to a missing blob: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+type archiveEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+}
+
+func writeTestArchive(t *testing.T, entries ...archiveEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		hdr := &tar.Header{Name: entry.name, Typeflag: entry.typeflag, Linkname: entry.linkname, Mode: 0644}
+		var data []byte
+		if entry.typeflag == tar.TypeReg {
+			data = []byte(entry.name)
+			hdr.Size = int64(len(data))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(t.TempDir(), "image.tar")
+	if err := os.WriteFile(archivePath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return archivePath
+}
+
+func TestExtractArchive(t *testing.T) {
+	archivePath := writeTestArchive(t,
+		archiveEntry{name: "./", typeflag: tar.TypeDir},
+		archiveEntry{name: "blobs/sha256/", typeflag: tar.TypeDir},
+		archiveEntry{name: "blobs/sha256/abc", typeflag: tar.TypeReg},
+		archiveEntry{name: "/index.json", typeflag: tar.TypeReg},
+		archiveEntry{name: "blobs/current", typeflag: tar.TypeSymlink, linkname: "sha256/abc"},
+		archiveEntry{name: "blobs/sha256/index", typeflag: tar.TypeSymlink, linkname: "../../index.json"},
+		archiveEntry{name: "blobs/sha256/def", typeflag: tar.TypeLink, linkname: "blobs/sha256/abc"},
+	)
+	dir := t.TempDir()
+	if err := extractArchive(archivePath, dir); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"blobs/sha256/abc":   "blobs/sha256/abc",
+		"blobs/sha256/def":   "blobs/sha256/abc",
+		"blobs/current":      "blobs/sha256/abc",
+		"blobs/sha256/index": "/index.json",
+		"index.json":         "/index.json",
+	} {
+		if data, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(data) != want {
+			t.Errorf("%s: got %q (%v), want %q", name, data, err, want)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "blobs/current")); err != nil || link != "sha256/abc" {
+		t.Errorf("got link %q (%v)", link, err)
+	}
+}
+
+func TestExtractArchiveEscaping(t *testing.T) {
+	cases := map[string][]archiveEntry{
+		"parent":          {{name: "../evil", typeflag: tar.TypeReg}},
+		"nested parent":   {{name: "blobs/../../evil", typeflag: tar.TypeReg}},
+		"absolute link":   {{name: "etc", typeflag: tar.TypeSymlink, linkname: "/etc"}},
+		"climbing link":   {{name: "blobs/etc", typeflag: tar.TypeSymlink, linkname: "../../etc"}},
+		"link in between": {{name: "link", typeflag: tar.TypeSymlink, linkname: "blobs/.."}},
+		"hard link":       {{name: "passwd", typeflag: tar.TypeLink, linkname: "../etc/passwd"}},
+		"through a link": {
+			{name: "here", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "here/out", typeflag: tar.TypeSymlink, linkname: "../etc"},
+		},
+	}
+	for name, entries := range cases {
+		t.Run(name, func(t *testing.T) {
+			outside := t.TempDir()
+			dir := filepath.Join(outside, "image")
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			err := extractArchive(writeTestArchive(t, entries...), dir)
+			if err == nil || !strings.Contains(err.Error(), "outside of the image") {
+				t.Errorf("got error %v, want the entry refused", err)
+			}
+			if _, err := os.Lstat(filepath.Join(outside, "evil")); !os.IsNotExist(err) {
+				t.Errorf("entry was written outside of the image: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const jksMagic = 0xfeedfeed
+const jceksMagic = 0xcececece
+
+const (
+	jksPrivateKeyTag  = 1
+	jksTrustedCertTag = 2
+)
+
+// part of every JKS digest since the beginning of time
+var jksWhitener = []byte("Mighty Aphrodite")
+
+type jksEntry struct {
+	alias string
+	// raw is the entry as it was read, written back as is
+	raw []byte
+}
+
+type jks struct {
+	version uint32
+	entries []jksEntry
+}
+
+func parseJKS(data []byte, password string) (*jks, error) {
+	if len(data) < 12+sha1.Size {
+		return nil, fmt.Errorf("keystore is truncated")
+	}
+	body := data[:len(data)-sha1.Size]
+	if password != "" {
+		digest := jksDigest(password, body)
+		if subtle.ConstantTimeCompare(digest, data[len(body):]) != 1 {
+			return nil, fmt.Errorf("keystore password is incorrect or keystore was tampered with")
+		}
+	}
+
+	r := &jksReader{data: body, offset: 4}
+	ks := &jks{version: r.uint32()}
+	if ks.version != 1 && ks.version != 2 {
+		return nil, fmt.Errorf("unsupported JKS version %d", ks.version)
+	}
+
+	count := r.uint32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		start := r.offset
+		tag := r.uint32()
+		alias := r.utf()
+		r.skip(8) // creation time
+		switch tag {
+		case jksPrivateKeyTag:
+			r.skip(int(r.uint32()))
+			chain := r.uint32()
+			for j := uint32(0); j < chain && r.err == nil; j++ {
+				r.certificate(ks.version)
+			}
+		case jksTrustedCertTag:
+			r.certificate(ks.version)
+		default:
+			return nil, fmt.Errorf("unknown JKS entry tag %d", tag)
+		}
+		if r.err != nil {
+			break
+		}
+		ks.entries = append(ks.entries, jksEntry{alias: alias, raw: body[start:r.offset]})
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("malformed JKS keystore: %w", r.err)
+	}
+	return ks, nil
+}
+
+func jksDigest(password string, body []byte) []byte {
+	h := sha1.New()
+	h.Write(passwordBytes(password, false))
+	h.Write(jksWhitener)
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+func (ks *jks) Format() string {
+	return "JKS"
+}
+
+func (ks *jks) Aliases() []string {
+	aliases := make([]string, len(ks.entries))
+	for i, entry := range ks.entries {
+		aliases[i] = entry.alias
+	}
+	return aliases
+}
+
+func (ks *jks) Contains(alias string) bool {
+	alias = strings.ToLower(alias)
+	for _, entry := range ks.entries {
+		if entry.alias == alias {
+			return true
+		}
+	}
+	return false
+}
+
+func (ks *jks) AddTrustedCertificate(alias string, der []byte, created time.Time) error {
+	// JKS aliases are case insensitive and always stored lowercase
+	alias = strings.ToLower(alias)
+	if len(alias) > 0xffff {
+		return fmt.Errorf("alias is too long")
+	}
+	ks.Remove(alias)
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(jksTrustedCertTag))
+	writeUTF(&buf, alias)
+	binary.Write(&buf, binary.BigEndian, created.UnixNano()/int64(time.Millisecond))
+	if ks.version == 2 {
+		writeUTF(&buf, "X.509")
+	}
+	binary.Write(&buf, binary.BigEndian, uint32(len(der)))
+	buf.Write(der)
+
+	ks.entries = append(ks.entries, jksEntry{alias: alias, raw: buf.Bytes()})
+	return nil
+}
+
+func (ks *jks) Remove(alias string) bool {
+	alias = strings.ToLower(alias)
+	for i, entry := range ks.entries {
+		if entry.alias == alias {
+			ks.entries = append(ks.entries[:i], ks.entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (ks *jks) Marshal(password string) ([]byte, error) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(jksMagic))
+	binary.Write(&buf, binary.BigEndian, ks.version)
+	binary.Write(&buf, binary.BigEndian, uint32(len(ks.entries)))
+	for _, entry := range ks.entries {
+		buf.Write(entry.raw)
+	}
+	buf.Write(jksDigest(password, buf.Bytes()))
+	return buf.Bytes(), nil
+}
+
+// writeUTF writes Java's DataOutput.writeUTF, which matches plain UTF-8 for
+// anything but NUL and characters outside the BMP
+func writeUTF(w io.Writer, s string) {
+	binary.Write(w, binary.BigEndian, uint16(len(s)))
+	io.WriteString(w, s)
+}
+
+type jksReader struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+func (r *jksReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.offset+n > len(r.data) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := r.data[r.offset : r.offset+n]
+	r.offset += n
+	return b
+}
+
+func (r *jksReader) skip(n int) {
+	r.next(n)
+}
+
+func (r *jksReader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *jksReader) utf() string {
+	b := r.next(2)
+	if b == nil {
+		return ""
+	}
+	return string(r.next(int(binary.BigEndian.Uint16(b))))
+}
+
+func (r *jksReader) certificate(version uint32) {
+	if version == 2 {
+		r.utf() // certificate type
+	}
+	r.skip(int(r.uint32()))
+}
@@ -0,0 +1,77 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package keystore reads and writes the keystore formats used by Java for its
+// trusted certificates, so they can be managed without keytool.
+package keystore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// DefaultPassword protects the cacerts shipped with every JDK
+const DefaultPassword = "changeit"
+
+type Keystore interface {
+	// Format is the name Java uses for it, as in keystore.type
+	Format() string
+	Aliases() []string
+	Contains(alias string) bool
+	// AddTrustedCertificate adds a DER encoded certificate, replacing any
+	// entry already using alias
+	AddTrustedCertificate(alias string, der []byte, created time.Time) error
+	// Remove reports whether alias was found
+	Remove(alias string) bool
+	Marshal(password string) ([]byte, error)
+}
+
+// Parse detects the format of data and verifies its integrity with password,
+// an empty password skips verification for JKS
+func Parse(data []byte, password string) (Keystore, error) {
+	switch {
+	case len(data) >= 4 && binary.BigEndian.Uint32(data) == jksMagic:
+		return parseJKS(data, password)
+	case len(data) >= 4 && binary.BigEndian.Uint32(data) == jceksMagic:
+		return nil, fmt.Errorf("JCEKS keystores are not supported")
+	case len(data) > 0 && data[0] == 0x30:
+		return parsePKCS12(data, password)
+	default:
+		return nil, fmt.Errorf("unknown keystore format")
+	}
+}
+
+// passwordBytes encodes password as UTF-16 big endian, which is what both
+// formats feed into their integrity checks
+func passwordBytes(password string, terminate bool) []byte {
+	var buf bytes.Buffer
+	for _, r := range password {
+		if r > 0xffff {
+			// surrogate pairs, as Java strings would have it
+			r -= 0x10000
+			binary.Write(&buf, binary.BigEndian, uint16(0xd800+(r>>10)))
+			binary.Write(&buf, binary.BigEndian, uint16(0xdc00+(r&0x3ff)))
+			continue
+		}
+		binary.Write(&buf, binary.BigEndian, uint16(r))
+	}
+	if terminate {
+		buf.Write([]byte{0, 0})
+	}
+	return buf.Bytes()
+}
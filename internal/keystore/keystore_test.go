@@ -0,0 +1,162 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAlias = "confiar-test"
+
+func testCertificate(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Keystore Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// roundTrip adds the test certificate to ks and parses the result back
+func roundTrip(t *testing.T, ks Keystore) []byte {
+	t.Helper()
+	if err := ks.AddTrustedCertificate(testAlias, testCertificate(t), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ks.Marshal(DefaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Parse(data, DefaultPassword)
+	if err != nil {
+		t.Fatalf("parsing written keystore: %v", err)
+	}
+	if !parsed.Contains(testAlias) {
+		t.Fatalf("written keystore is missing %s, has %v", testAlias, parsed.Aliases())
+	}
+	if _, err := Parse(data, "wrong"); err == nil {
+		t.Fatal("written keystore accepted the wrong password")
+	}
+	return data
+}
+
+// runTool runs name with args, skipping the test when it is not installed
+func runTool(t *testing.T, name string, args ...string) string {
+	t.Helper()
+	if _, err := exec.LookPath(name); err != nil {
+		t.Skipf("%s not installed", name)
+	}
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s rejected the keystore: %v\n%s", name, err, out)
+	}
+	return string(out)
+}
+
+func writeKeystore(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cacerts")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJKS(t *testing.T) {
+	data := roundTrip(t, &jks{version: 2})
+
+	t.Run("keytool", func(t *testing.T) {
+		out := runTool(t, "keytool", "-list", "-storetype", "JKS", "-keystore", writeKeystore(t, data), "-storepass", DefaultPassword)
+		if !strings.Contains(out, testAlias) || !strings.Contains(out, "trustedCertEntry") {
+			t.Fatalf("keytool does not list %s as trusted:\n%s", testAlias, out)
+		}
+	})
+}
+
+func TestPKCS12(t *testing.T) {
+	ks := &pkcs12{mac: &macData{
+		Mac: digestInfo{Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1},
+			Parameters: asn1.NullRawValue,
+		}},
+		MacSalt:    make([]byte, 20),
+		Iterations: 10000,
+	}}
+	checkPKCS12(t, roundTrip(t, ks))
+}
+
+// TestPKCS12Fixture adds to a truststore written by openssl pkcs12 -export,
+// whose certificate is encrypted and has to be kept as it was
+func TestPKCS12Fixture(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/truststore.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := Parse(fixture, DefaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := roundTrip(t, ks)
+	checkPKCS12(t, data)
+
+	t.Run("openssl keeps fixture", func(t *testing.T) {
+		out := runTool(t, "openssl", "pkcs12", "-info", "-nokeys", "-in", writeKeystore(t, data), "-passin", "pass:"+DefaultPassword)
+		if !strings.Contains(out, "CN = Fixture Root CA") {
+			t.Fatalf("fixture certificate is gone:\n%s", out)
+		}
+	})
+}
+
+func checkPKCS12(t *testing.T, data []byte) {
+	t.Run("openssl", func(t *testing.T) {
+		out := runTool(t, "openssl", "pkcs12", "-info", "-nokeys", "-in", writeKeystore(t, data), "-passin", "pass:"+DefaultPassword)
+		if !strings.Contains(out, "friendlyName: "+testAlias) || !strings.Contains(out, "CN = Keystore Test CA") {
+			t.Fatalf("openssl does not show %s:\n%s", testAlias, out)
+		}
+	})
+	t.Run("keytool", func(t *testing.T) {
+		out := runTool(t, "keytool", "-list", "-storetype", "PKCS12", "-keystore", writeKeystore(t, data), "-storepass", DefaultPassword)
+		if !strings.Contains(out, testAlias) || !strings.Contains(out, "trustedCertEntry") {
+			t.Fatalf("keytool does not list %s as trusted:\n%s", testAlias, out)
+		}
+	})
+}
@@ -0,0 +1,414 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"time"
+	"unicode/utf16"
+)
+
+var (
+	oidData           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidCertTypeX509   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidAnyExtKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+
+	// ORACLE_TrustedKeyUsage, without it Java treats certificate bags as
+	// part of some key's chain rather than trusted on their own
+	oidJavaTrustedKeyUsage = asn1.ObjectIdentifier{2, 16, 840, 1, 113894, 746875, 1, 1}
+
+	macHashes = map[string]crypto.Hash{
+		"1.3.14.3.2.26":          crypto.SHA1,
+		"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+		"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+		"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+	}
+)
+
+type pfxPDU struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID asn1.ObjectIdentifier
+	// the SET of values, kept raw
+	Value asn1.RawValue
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+// pkcs12SafeContents is one ContentInfo of the AuthenticatedSafe, only
+// unencrypted ones are looked into, others are written back untouched
+type pkcs12SafeContents struct {
+	raw []byte
+	// bags is nil for encrypted contents
+	bags []pkcs12Bag
+}
+
+type pkcs12Bag struct {
+	alias string
+	raw   []byte
+}
+
+type pkcs12 struct {
+	contents []*pkcs12SafeContents
+	mac      *macData
+}
+
+func parsePKCS12(data []byte, password string) (*pkcs12, error) {
+	var pfx pfxPDU
+	if rest, err := asn1.Unmarshal(data, &pfx); err != nil {
+		return nil, fmt.Errorf("malformed PKCS#12 keystore: %w", err)
+	} else if len(rest) > 0 {
+		return nil, fmt.Errorf("malformed PKCS#12 keystore: trailing data")
+	}
+	if pfx.Version != 3 {
+		return nil, fmt.Errorf("unsupported PKCS#12 version %d", pfx.Version)
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidData) {
+		return nil, fmt.Errorf("PKCS#12 keystores protected by public key are not supported")
+	}
+
+	var authSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		return nil, fmt.Errorf("malformed PKCS#12 keystore: %w", err)
+	}
+
+	ks := &pkcs12{}
+	if pfx.MacData.Mac.Algorithm.Algorithm != nil {
+		ks.mac = &pfx.MacData
+		expected, err := pkcs12MAC(ks.mac, password, authSafe)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(expected, ks.mac.Mac.Digest) {
+			return nil, fmt.Errorf("keystore password is incorrect or keystore was tampered with")
+		}
+	}
+
+	var rawContents []asn1.RawValue
+	if _, err := asn1.Unmarshal(authSafe, &rawContents); err != nil {
+		return nil, fmt.Errorf("malformed PKCS#12 keystore: %w", err)
+	}
+	for _, raw := range rawContents {
+		contents, err := parseSafeContents(raw.FullBytes)
+		if err != nil {
+			return nil, err
+		}
+		ks.contents = append(ks.contents, contents)
+	}
+	return ks, nil
+}
+
+func parseSafeContents(raw []byte) (*pkcs12SafeContents, error) {
+	contents := &pkcs12SafeContents{raw: raw}
+
+	var info contentInfo
+	if _, err := asn1.Unmarshal(raw, &info); err != nil {
+		return nil, fmt.Errorf("malformed PKCS#12 content: %w", err)
+	}
+	if !info.ContentType.Equal(oidData) {
+		return contents, nil
+	}
+
+	var safeContents []byte
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &safeContents); err != nil {
+		return nil, fmt.Errorf("malformed PKCS#12 content: %w", err)
+	}
+	var rawBags []asn1.RawValue
+	if _, err := asn1.Unmarshal(safeContents, &rawBags); err != nil {
+		return nil, fmt.Errorf("malformed PKCS#12 safe contents: %w", err)
+	}
+	contents.bags = []pkcs12Bag{}
+	for _, rawBag := range rawBags {
+		var bag safeBag
+		if _, err := asn1.Unmarshal(rawBag.FullBytes, &bag); err != nil {
+			return nil, fmt.Errorf("malformed PKCS#12 bag: %w", err)
+		}
+		contents.bags = append(contents.bags, pkcs12Bag{alias: friendlyName(&bag), raw: rawBag.FullBytes})
+	}
+	return contents, nil
+}
+
+func friendlyName(bag *safeBag) string {
+	for _, attr := range bag.Attributes {
+		if !attr.ID.Equal(oidFriendlyName) {
+			continue
+		}
+		var name asn1.RawValue
+		if _, err := asn1.Unmarshal(attr.Value.Bytes, &name); err != nil || name.Tag != asn1.TagBMPString || len(name.Bytes)%2 != 0 {
+			return ""
+		}
+		units := make([]uint16, len(name.Bytes)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(name.Bytes[2*i:])
+		}
+		return string(utf16.Decode(units))
+	}
+	return ""
+}
+
+func (ks *pkcs12) Format() string {
+	return "PKCS12"
+}
+
+func (ks *pkcs12) Aliases() []string {
+	aliases := []string{}
+	for _, contents := range ks.contents {
+		for _, bag := range contents.bags {
+			if bag.alias != "" {
+				aliases = append(aliases, bag.alias)
+			}
+		}
+	}
+	return aliases
+}
+
+func (ks *pkcs12) Contains(alias string) bool {
+	for _, existing := range ks.Aliases() {
+		if existing == alias {
+			return true
+		}
+	}
+	return false
+}
+
+func (ks *pkcs12) AddTrustedCertificate(alias string, der []byte, created time.Time) error {
+	ks.Remove(alias)
+
+	bagValue, err := asn1.Marshal(certBag{ID: oidCertTypeX509, Data: der})
+	if err != nil {
+		return err
+	}
+	friendly, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: passwordBytes(alias, false)})
+	if err != nil {
+		return err
+	}
+	usage, err := asn1.Marshal(oidAnyExtKeyUsage)
+	if err != nil {
+		return err
+	}
+	bag, err := asn1.Marshal(safeBag{
+		ID:    oidCertBag,
+		Value: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: bagValue},
+		Attributes: []pkcs12Attribute{
+			{ID: oidFriendlyName, Value: asn1Set(friendly)},
+			{ID: oidJavaTrustedKeyUsage, Value: asn1Set(usage)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	ks.contents = append(ks.contents, &pkcs12SafeContents{
+		bags: []pkcs12Bag{{alias: alias, raw: bag}},
+	})
+	return nil
+}
+
+func (ks *pkcs12) Remove(alias string) bool {
+	found := false
+	kept := []*pkcs12SafeContents{}
+	for _, contents := range ks.contents {
+		if contents.bags == nil {
+			kept = append(kept, contents)
+			continue
+		}
+		bags := []pkcs12Bag{}
+		for _, bag := range contents.bags {
+			if bag.alias == alias {
+				found = true
+				continue
+			}
+			bags = append(bags, bag)
+		}
+		if len(bags) != len(contents.bags) {
+			contents.raw = nil
+			contents.bags = bags
+		}
+		if len(bags) > 0 {
+			kept = append(kept, contents)
+		}
+	}
+	ks.contents = kept
+	return found
+}
+
+func (ks *pkcs12) Marshal(password string) ([]byte, error) {
+	rawContents := []asn1.RawValue{}
+	for _, contents := range ks.contents {
+		raw, err := contents.marshal()
+		if err != nil {
+			return nil, err
+		}
+		rawContents = append(rawContents, asn1.RawValue{FullBytes: raw})
+	}
+	authSafe, err := asn1.Marshal(rawContents)
+	if err != nil {
+		return nil, err
+	}
+
+	pfx := pfxPDU{Version: 3}
+	pfx.AuthSafe, err = dataContentInfo(authSafe)
+	if err != nil {
+		return nil, err
+	}
+	if ks.mac != nil {
+		mac := *ks.mac
+		mac.MacSalt = make([]byte, len(ks.mac.MacSalt))
+		if _, err := rand.Read(mac.MacSalt); err != nil {
+			return nil, err
+		}
+		if mac.Mac.Digest, err = pkcs12MAC(&mac, password, authSafe); err != nil {
+			return nil, err
+		}
+		pfx.MacData = mac
+	}
+	return asn1.Marshal(pfx)
+}
+
+func (contents *pkcs12SafeContents) marshal() ([]byte, error) {
+	if contents.raw != nil {
+		return contents.raw, nil
+	}
+	rawBags := make([]asn1.RawValue, len(contents.bags))
+	for i, bag := range contents.bags {
+		rawBags[i] = asn1.RawValue{FullBytes: bag.raw}
+	}
+	safeContents, err := asn1.Marshal(rawBags)
+	if err != nil {
+		return nil, err
+	}
+	info, err := dataContentInfo(safeContents)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(info)
+}
+
+func dataContentInfo(data []byte) (contentInfo, error) {
+	octets, err := asn1.Marshal(data)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	return contentInfo{
+		ContentType: oidData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: octets},
+	}, nil
+}
+
+func asn1Set(contents []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: contents}
+}
+
+func pkcs12MAC(mac *macData, password string, authSafe []byte) ([]byte, error) {
+	hash, ok := macHashes[mac.Mac.Algorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported PKCS#12 MAC algorithm %s", mac.Mac.Algorithm.Algorithm)
+	}
+	key := pkcs12KDF(hash, passwordBytes(password, true), mac.MacSalt, mac.Iterations, 3, hash.Size())
+	h := hmac.New(hash.New, key)
+	h.Write(authSafe)
+	return h.Sum(nil), nil
+}
+
+// pkcs12KDF derives key material as described in RFC 7292 appendix B.2, id 3
+// being for MAC keys
+func pkcs12KDF(hash crypto.Hash, password []byte, salt []byte, iterations int, id byte, size int) []byte {
+	v := hash.New().BlockSize()
+
+	diversifier := bytes.Repeat([]byte{id}, v)
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	input := append(fill(salt), fill(password)...)
+
+	one := big.NewInt(1)
+	modulus := new(big.Int).Lsh(one, uint(v*8))
+	out := []byte{}
+	for len(out) < size {
+		h := hash.New()
+		h.Write(diversifier)
+		h.Write(input)
+		a := h.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			h.Reset()
+			h.Write(a)
+			a = h.Sum(a[:0])
+		}
+		out = append(out, a...)
+
+		b := new(big.Int).SetBytes(fill(a)[:v])
+		b.Add(b, one)
+		for j := 0; j < len(input); j += v {
+			block := new(big.Int).SetBytes(input[j : j+v])
+			block.Add(block, b)
+			block.Mod(block, modulus)
+			sum := block.Bytes()
+			copy(input[j:j+v], make([]byte, v-len(sum)))
+			copy(input[j+v-len(sum):j+v], sum)
+		}
+	}
+	return out[:size]
+}
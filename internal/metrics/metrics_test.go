@@ -0,0 +1,92 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func scrape(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != contentType {
+		t.Errorf("got content type %q, want %q", got, contentType)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestExpose(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewConstGauge("test_build_info", "Build information.", 1, map[string]string{
+		"version": "v1.2.3",
+		"go":      "go1.16",
+	})
+	registry.NewGaugeFunc("test_missing", "Not exposed without a value.", func() (float64, bool) {
+		return 0, false
+	})
+	registry.NewGaugeFunc("test_expiry_seconds", "Seconds until expiry.", func() (float64, bool) {
+		return 1.5e6, true
+	})
+	requests := registry.NewCounterVec("test_requests_total", "Requests by path.", "path", "code")
+	requests.Inc("/", "200")
+	requests.Inc("/", "200")
+	requests.Inc(`/"quoted"\path`+"\nnext", "404")
+	registry.NewCounterVec("test_empty_total", "Counter without values.", "path")
+
+	want := `# HELP test_build_info Build information.
+# TYPE test_build_info gauge
+test_build_info{go="go1.16",version="v1.2.3"} 1
+# HELP test_expiry_seconds Seconds until expiry.
+# TYPE test_expiry_seconds gauge
+test_expiry_seconds 1.5e+06
+# HELP test_requests_total Requests by path.
+# TYPE test_requests_total counter
+test_requests_total{path="/",code="200"} 2
+test_requests_total{path="/\"quoted\"\\path\nnext",code="404"} 1
+# HELP test_empty_total Counter without values.
+# TYPE test_empty_total counter
+`
+	if got := scrape(t, registry); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCounterVecLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a missing label value")
+		}
+	}()
+	NewRegistry().NewCounterVec("test_total", "Test.", "path", "code").Inc("/")
+}
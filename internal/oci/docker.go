@@ -0,0 +1,131 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oci
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AnnotationImageName is the full image name docker save and containerd
+// record next to AnnotationRefName
+const AnnotationImageName = "io.containerd.image.name"
+
+// DockerImage is an entry of manifest.json, which docker save writes next to
+// the OCI layout and docker load reads instead of index.json
+type DockerImage struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+
+	// the rest is kept as it was, such as LayerSources
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+func (d *DockerImage) UnmarshalJSON(data []byte) error {
+	type plain DockerImage
+	if err := json.Unmarshal(data, (*plain)(d)); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &d.Extra); err != nil {
+		return err
+	}
+	for _, key := range []string{"Config", "RepoTags", "Layers"} {
+		delete(d.Extra, key)
+	}
+	return nil
+}
+
+func (d DockerImage) MarshalJSON() ([]byte, error) {
+	fields := map[string]interface{}{}
+	for key, value := range d.Extra {
+		fields[key] = value
+	}
+	fields["Config"] = d.Config
+	fields["RepoTags"] = d.RepoTags
+	fields["Layers"] = d.Layers
+	return json.Marshal(fields)
+}
+
+// BlobName is where docker save's manifest.json refers to a blob
+func BlobName(digest string) string {
+	return "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+// ReadDockerManifest returns the images of manifest.json, nil when the layout
+// was not written by docker save
+func (l *Layout) ReadDockerManifest() ([]DockerImage, error) {
+	data, err := os.ReadFile(filepath.Join(l.Dir, "manifest.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	images := []DockerImage{}
+	if err := json.Unmarshal(data, &images); err != nil {
+		return nil, fmt.Errorf("unable to parse manifest.json: %w", err)
+	}
+	return images, nil
+}
+
+func (l *Layout) WriteDockerManifest(images []DockerImage) error {
+	data, err := json.Marshal(images)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(l.Dir, "manifest.json"), data, 0644)
+}
+
+// ReadRepositories returns the legacy repositories file of docker save,
+// mapping repository and tag to the top layer, nil when there is none
+func (l *Layout) ReadRepositories() (map[string]map[string]string, error) {
+	data, err := os.ReadFile(filepath.Join(l.Dir, "repositories"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	repositories := map[string]map[string]string{}
+	if err := json.Unmarshal(data, &repositories); err != nil {
+		return nil, fmt.Errorf("unable to parse repositories: %w", err)
+	}
+	return repositories, nil
+}
+
+func (l *Layout) WriteRepositories(repositories map[string]map[string]string) error {
+	data, err := json.Marshal(repositories)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(l.Dir, "repositories"), data, 0644)
+}
+
+// SplitRepoTag separates repository and tag of name:tag, the tag is empty
+// when there is none
+func SplitRepoTag(repoTag string) (string, string) {
+	if i := strings.LastIndex(repoTag, ":"); i > strings.LastIndex(repoTag, "/") {
+		return repoTag[:i], repoTag[i+1:]
+	}
+	return repoTag, ""
+}
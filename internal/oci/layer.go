@@ -0,0 +1,237 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oci
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const whiteoutPrefix = ".wh."
+const whiteoutOpaque = ".wh..wh..opq"
+
+type fileEntry struct {
+	typeflag byte
+	linkname string
+	data     []byte
+}
+
+// Filesystem is the result of applying layers on top of each other, limited
+// to the regular files Keep is interested in, along with links and directories
+type Filesystem struct {
+	Keep    func(name string) bool
+	entries map[string]*fileEntry
+}
+
+func NewFilesystem(keep func(name string) bool) *Filesystem {
+	return &Filesystem{Keep: keep, entries: map[string]*fileEntry{}}
+}
+
+// Apply adds a layer, gzip compressed or not, honouring whiteouts
+func (f *Filesystem) Apply(layer io.Reader) error {
+	buffered := bufio.NewReader(layer)
+	var r io.Reader = buffered
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read layer: %w", err)
+		}
+		name := path.Clean("/" + hdr.Name)
+		dir, base := path.Split(name)
+
+		if base == whiteoutOpaque {
+			f.remove(path.Clean(dir), false)
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			f.remove(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), true)
+			continue
+		}
+
+		// a later layer replacing a directory by anything else drops its
+		// contents, directories are merged
+		if hdr.Typeflag != tar.TypeDir {
+			f.remove(name, true)
+		}
+		entry := &fileEntry{typeflag: hdr.Typeflag, linkname: hdr.Linkname}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			if !f.Keep(name) {
+				continue
+			}
+			if entry.data, err = io.ReadAll(tr); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			entry.linkname = path.Clean("/" + hdr.Linkname)
+		}
+		f.entries[name] = entry
+	}
+}
+
+// remove drops the contents of dir, and dir itself when self
+func (f *Filesystem) remove(dir string, self bool) {
+	if self {
+		delete(f.entries, dir)
+	}
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for name := range f.entries {
+		if strings.HasPrefix(name, prefix) {
+			delete(f.entries, name)
+		}
+	}
+}
+
+// ReadFile returns the contents of name, following links within the layers
+func (f *Filesystem) ReadFile(name string) ([]byte, error) {
+	name = path.Clean("/" + name)
+	for hops := 0; hops < 40; hops++ {
+		resolved, err := f.resolveParents(name)
+		if err != nil {
+			return nil, err
+		}
+		entry, ok := f.entries[resolved]
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		}
+		switch entry.typeflag {
+		case tar.TypeSymlink:
+			if path.IsAbs(entry.linkname) {
+				name = path.Clean(entry.linkname)
+			} else {
+				name = path.Join(path.Dir(resolved), entry.linkname)
+			}
+		case tar.TypeLink:
+			name = entry.linkname
+		case tar.TypeReg, tar.TypeRegA:
+			return entry.data, nil
+		default:
+			return nil, fmt.Errorf("%s: not a regular file", name)
+		}
+	}
+	return nil, fmt.Errorf("%s: too many levels of symbolic links", name)
+}
+
+// resolveParents follows symbolic links among the directories leading to name
+func (f *Filesystem) resolveParents(name string) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	resolved := "/"
+	for hops := 0; len(parts) > 1; {
+		candidate := path.Join(resolved, parts[0])
+		entry, ok := f.entries[candidate]
+		if !ok || entry.typeflag != tar.TypeSymlink {
+			resolved = candidate
+			parts = parts[1:]
+			continue
+		}
+		if hops++; hops > 40 {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", name)
+		}
+		link := entry.linkname
+		if !path.IsAbs(link) {
+			link = path.Join(resolved, link)
+		}
+		parts = append(strings.Split(strings.TrimPrefix(path.Clean(link), "/"), "/"), parts[1:]...)
+		resolved = "/"
+	}
+	return path.Join(resolved, parts[0]), nil
+}
+
+// NewLayer builds a gzip compressed layer holding files, with their parent
+// directories, all owned by root and dated modTime so that the same input
+// gives the same layer. It returns the layer and the digest of its
+// uncompressed contents, its diff ID.
+func NewLayer(files map[string][]byte, modTime time.Time) ([]byte, string, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var uncompressed bytes.Buffer
+	tw := tar.NewWriter(&uncompressed)
+	dirs := map[string]bool{}
+	for _, name := range names {
+		rel := strings.TrimPrefix(path.Clean("/"+name), "/")
+
+		parents := []string{}
+		for dir := path.Dir(rel); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+			parents = append([]string{dir}, parents...)
+		}
+		for _, dir := range parents {
+			dirs[dir] = true
+			if err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     dir + "/",
+				Mode:     0755,
+				ModTime:  modTime,
+				Format:   tar.FormatPAX,
+			}); err != nil {
+				return nil, "", err
+			}
+		}
+
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     rel,
+			Mode:     0644,
+			Size:     int64(len(files[name])),
+			ModTime:  modTime,
+			Format:   tar.FormatPAX,
+		}); err != nil {
+			return nil, "", err
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, "", err
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(uncompressed.Bytes()); err != nil {
+		return nil, "", err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, "", err
+	}
+	return compressed.Bytes(), Digest(uncompressed.Bytes()), nil
+}
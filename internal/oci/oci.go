@@ -0,0 +1,205 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package oci reads and writes images in OCI image layouts, just enough to
+// add layers to existing images.
+package oci
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	MediaTypeImageIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeImageManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeImageLayer    = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeImageLayerGz  = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// images built by Docker keep its media types when saved as OCI layout
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerLayerGz      = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+)
+
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	URLs         []string          `json:"urls,omitempty"`
+	Platform     json.RawMessage   `json:"platform,omitempty"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// IsIndex reports whether the descriptor points to a list of manifests
+func (d *Descriptor) IsIndex() bool {
+	return d.MediaType == MediaTypeImageIndex || d.MediaType == MediaTypeDockerManifestList
+}
+
+// IsManifest reports whether the descriptor points to an image manifest
+func (d *Descriptor) IsManifest() bool {
+	return d.MediaType == MediaTypeImageManifest || d.MediaType == MediaTypeDockerManifest
+}
+
+type Index struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Manifests     []Descriptor      `json:"manifests"`
+	Subject       *Descriptor       `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Subject       *Descriptor       `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Layout is an OCI image layout directory
+type Layout struct {
+	Dir string
+}
+
+func OpenLayout(dir string) (*Layout, error) {
+	if _, err := os.Stat(filepath.Join(dir, "oci-layout")); err != nil {
+		return nil, fmt.Errorf("%s is not an OCI image layout: %w", dir, err)
+	}
+	return &Layout{Dir: dir}, nil
+}
+
+func (l *Layout) ReadIndex() (*Index, error) {
+	data, err := os.ReadFile(filepath.Join(l.Dir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	index := &Index{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("unable to parse index.json: %w", err)
+	}
+	return index, nil
+}
+
+func (l *Layout) WriteIndex(index *Index) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(l.Dir, "index.json"), data, 0644)
+}
+
+func (l *Layout) blobPath(digest string) (string, error) {
+	algorithm, encoded, ok := cut(digest, ":")
+	if !ok || algorithm != "sha256" || len(encoded) != sha256.Size*2 || strings.ContainsAny(encoded, "/.") {
+		return "", fmt.Errorf("unsupported digest: %s", digest)
+	}
+	return filepath.Join(l.Dir, "blobs", algorithm, encoded), nil
+}
+
+func (l *Layout) OpenBlob(digest string) (io.ReadCloser, error) {
+	blobPath, err := l.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(blobPath)
+}
+
+// ReadBlob reads a blob and checks it against its digest
+func (l *Layout) ReadBlob(digest string) ([]byte, error) {
+	blob, err := l.OpenBlob(digest)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		return nil, err
+	}
+	if Digest(data) != digest {
+		return nil, fmt.Errorf("blob %s does not match its digest", digest)
+	}
+	return data, nil
+}
+
+// WriteBlob stores data and describes it as mediaType
+func (l *Layout) WriteBlob(mediaType string, data []byte) (Descriptor, error) {
+	desc := Descriptor{
+		MediaType: mediaType,
+		Digest:    Digest(data),
+		Size:      int64(len(data)),
+	}
+	blobPath, err := l.blobPath(desc.Digest)
+	if err != nil {
+		return desc, err
+	}
+	if _, err := os.Stat(blobPath); err == nil {
+		return desc, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return desc, err
+	}
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return desc, err
+	}
+	return desc, os.WriteFile(blobPath, data, 0644)
+}
+
+// ReadJSON reads the blob desc points to into v
+func (l *Layout) ReadJSON(desc Descriptor, v interface{}) error {
+	data, err := l.ReadBlob(desc.Digest)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("unable to parse %s: %w", desc.Digest, err)
+	}
+	return nil
+}
+
+// WriteJSON stores v as a blob of mediaType
+func (l *Layout) WriteJSON(mediaType string, v interface{}) (Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	return l.WriteBlob(mediaType, data)
+}
+
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func cut(s string, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
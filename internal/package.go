@@ -0,0 +1,216 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/wilsonehusin/confiar/internal/certs"
+	"github.com/wilsonehusin/confiar/internal/packaging"
+	"github.com/wilsonehusin/confiar/internal/target"
+)
+
+// Debian keeps /usr/local/share/ca-certificates to the local administrator,
+// packages ship below debianCertsDir and list their certificates, relative to
+// it, in debianCertsConf for update-ca-certificates to pick them up
+const (
+	debianCertsDir  = "/usr/share/ca-certificates"
+	debianCertsConf = "/etc/ca-certificates.conf"
+)
+
+// packageDistros picks the trust store a package format installs into by
+// default
+var packageDistros = map[string]string{
+	"deb": "debian",
+	"rpm": "rhel",
+}
+
+type PackageConfig struct {
+	CertSrc string
+	Format  string
+
+	// Distro overrides the trust store layout, e.g. suse for an rpm
+	Distro string
+
+	// Name, Version and Release default to values derived from the
+	// certificate, so that a renewed certificate upgrades the package
+	Name       string
+	Version    string
+	Release    string
+	Maintainer string
+
+	OutDir string
+}
+
+// BuildPackage writes a package installing the certificate into the system
+// trust store to OutDir, returning its path.
+func BuildPackage(config *PackageConfig) (string, error) {
+	format, err := packaging.NewFormat(config.Format)
+	if err != nil {
+		return "", err
+	}
+	distro := config.Distro
+	if distro == "" {
+		distro = packageDistros[config.Format]
+	}
+
+	fetched, err := fetchCertificate(config.CertSrc, "")
+	if err != nil {
+		return "", err
+	}
+	defer fetched.cleanup()
+	certBytes, err := os.ReadFile(fetched.path)
+	if err != nil {
+		return "", err
+	}
+	certData, err := certs.ParsePEM(certBytes)
+	if err != nil {
+		return "", err
+	}
+
+	anchor, err := target.NewTrustAnchor(distro, certData)
+	if err != nil {
+		return "", err
+	}
+
+	certFile := anchor.Path
+	postInstall := trustUpdateScript(anchor.UpdateCommand)
+	postRemove := trustUpdateScript(anchor.RemoveCommand)
+	if anchor.Store == "debian" {
+		certFile = path.Join(debianCertsDir, "confiar", path.Base(anchor.Path))
+		postInstall, postRemove = debianScripts(strings.TrimPrefix(certFile, debianCertsDir+"/"), anchor)
+	}
+
+	spec := &packaging.Spec{
+		Name:       config.Name,
+		Version:    config.Version,
+		Release:    config.Release,
+		Maintainer: config.Maintainer,
+		Summary:    fmt.Sprintf("Trusts the certificate authority %s", certSubject(certData)),
+		Description: fmt.Sprintf("Adds the certificate authority %s to the system trust store.\n\nSHA-256 fingerprint: %s",
+			certSubject(certData), certs.Fingerprint(certData.Raw)),
+		Depends:     []string{"ca-certificates"},
+		Files:       []packaging.File{{Path: certFile, Data: certBytes, Mode: 0644}},
+		PostInstall: postInstall,
+		PostRemove:  postRemove,
+		ModTime:     certData.NotBefore.UTC(),
+	}
+	if spec.Name == "" {
+		spec.Name = packageName(certData)
+	}
+	if spec.Version == "" {
+		spec.Version = certData.NotBefore.UTC().Format("20060102.150405")
+	}
+
+	if err := os.MkdirAll(config.OutDir, 0755); err != nil {
+		return "", err
+	}
+	outPath := filepath.Join(config.OutDir, format.Filename(spec))
+	out, err := os.Create(outPath)
+	if err != nil {
+		return "", err
+	}
+	if err := format.Write(out, spec); err != nil {
+		out.Close()
+		os.Remove(outPath)
+		return "", fmt.Errorf("unable to write package: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	log.Info().Str("package", outPath).Str("file", certFile).Str("distro", distro).Msg("package written")
+	return outPath, nil
+}
+
+// trustUpdateScript tolerates the tooling being absent, as when the package
+// is installed into an image before ca-certificates is
+func trustUpdateScript(command []string) string {
+	return fmt.Sprintf("#!/bin/sh\nset -e\nif command -v %s >/dev/null 2>&1; then\n  %s\nfi\n",
+		command[0], strings.Join(command, " "))
+}
+
+const debianPostInstall = `#!/bin/sh
+set -e
+if [ "$1" = configure ]; then
+  if ! grep -qxF '{{entry}}' {{conf}} 2>/dev/null && ! grep -qxF '!{{entry}}' {{conf}} 2>/dev/null; then
+    echo '{{entry}}' >> {{conf}}
+  fi
+  if command -v {{tool}} >/dev/null 2>&1; then
+    {{update}}
+  fi
+fi
+`
+
+const debianPostRemove = `#!/bin/sh
+set -e
+if [ "$1" = remove ] || [ "$1" = purge ]; then
+  if [ -f {{conf}} ]; then
+    sed -i '/^!\{0,1\}{{pattern}}$/d' {{conf}}
+  fi
+  if command -v {{tool}} >/dev/null 2>&1; then
+    {{remove}}
+  fi
+fi
+`
+
+// debianScripts register the certificate in debianCertsConf when configured
+// and unregister it on removal, also when deselected there with "!"
+func debianScripts(entry string, anchor *target.TrustAnchor) (string, string) {
+	replacer := strings.NewReplacer(
+		"{{entry}}", entry,
+		"{{pattern}}", strings.NewReplacer(".", `\.`, "/", `\/`).Replace(entry),
+		"{{conf}}", debianCertsConf,
+		"{{tool}}", anchor.UpdateCommand[0],
+		"{{update}}", strings.Join(anchor.UpdateCommand, " "),
+		"{{remove}}", strings.Join(anchor.RemoveCommand, " "),
+	)
+	return replacer.Replace(debianPostInstall), replacer.Replace(debianPostRemove)
+}
+
+var unsafePackageChars = regexp.MustCompile(`[^a-z0-9.+-]+`)
+
+// packageName is valid for both dpkg and rpm, which are pickier than file
+// names
+func packageName(certData *x509.Certificate) string {
+	name := certs.Fingerprint(certData.Raw)[:16]
+	switch {
+	case len(certData.DNSNames) > 0:
+		name = certData.DNSNames[0]
+	case len(certData.IPAddresses) > 0:
+		name = certData.IPAddresses[0].String()
+	}
+	name = unsafePackageChars.ReplaceAllString(strings.ToLower(name), "-")
+	return "confiar-ca-" + strings.Trim(name, ".-")
+}
+
+func certSubject(certData *x509.Certificate) string {
+	if certData.Subject.CommonName != "" {
+		return certData.Subject.CommonName
+	}
+	if len(certData.DNSNames) > 0 {
+		return certData.DNSNames[0]
+	}
+	return certData.Subject.String()
+}
@@ -0,0 +1,201 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packaging
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Deb writes Debian binary packages, an ar archive of debian-binary,
+// control.tar.gz and data.tar.gz in that order
+type Deb struct{}
+
+func (d *Deb) Filename(spec *Spec) string {
+	return fmt.Sprintf("%s_%s_all.deb", spec.Name, d.version(spec))
+}
+
+func (d *Deb) version(spec *Spec) string {
+	if spec.Release == "" {
+		return spec.Version
+	}
+	return spec.Version + "-" + spec.Release
+}
+
+func (d *Deb) Write(w io.Writer, spec *Spec) error {
+	data, err := tarGz(spec.ModTime, func(tw *tar.Writer) error {
+		return writeTree(tw, spec.Files, spec.ModTime)
+	})
+	if err != nil {
+		return err
+	}
+	control, err := tarGz(spec.ModTime, func(tw *tar.Writer) error {
+		members := []File{
+			{Path: "control", Data: []byte(d.control(spec)), Mode: 0644},
+			{Path: "md5sums", Data: []byte(md5sums(spec.Files)), Mode: 0644},
+		}
+		if spec.PostInstall != "" {
+			members = append(members, File{Path: "postinst", Data: []byte(spec.PostInstall), Mode: 0755})
+		}
+		if spec.PostRemove != "" {
+			members = append(members, File{Path: "postrm", Data: []byte(spec.PostRemove), Mode: 0755})
+		}
+		for _, member := range members {
+			if err := writeTarFile(tw, "./"+member.Path, member.Data, int64(member.Mode), spec.ModTime); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, "!<arch>\n"); err != nil {
+		return err
+	}
+	for _, member := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", control},
+		{"data.tar.gz", data},
+	} {
+		if err := writeArMember(w, member.name, member.data, spec.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Deb) control(spec *Spec) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Package: %s\n", spec.Name)
+	fmt.Fprintf(&b, "Version: %s\n", d.version(spec))
+	b.WriteString("Architecture: all\n")
+	fmt.Fprintf(&b, "Maintainer: %s\n", spec.Maintainer)
+	fmt.Fprintf(&b, "Installed-Size: %d\n", (spec.installedSize()+1023)/1024)
+	if len(spec.Depends) > 0 {
+		fmt.Fprintf(&b, "Depends: %s\n", strings.Join(spec.Depends, ", "))
+	}
+	b.WriteString("Section: misc\nPriority: optional\n")
+	fmt.Fprintf(&b, "Description: %s\n", spec.Summary)
+	// continuation lines start with a space, empty ones are a lone dot
+	for _, line := range strings.Split(strings.TrimSpace(spec.Description), "\n") {
+		if strings.TrimSpace(line) == "" {
+			line = "."
+		}
+		fmt.Fprintf(&b, " %s\n", line)
+	}
+	return b.String()
+}
+
+func md5sums(files []File) string {
+	var b strings.Builder
+	for _, file := range files {
+		fmt.Fprintf(&b, "%x  %s\n", md5.Sum(file.Data), strings.TrimPrefix(file.Path, "/"))
+	}
+	return b.String()
+}
+
+func writeArMember(w io.Writer, name string, data []byte, modTime time.Time) error {
+	header := fmt.Sprintf("%-16s%-12d%-6d%-6d%-8o%-10d`\n", name, modTime.Unix(), 0, 0, 0100644, len(data))
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if len(data)%2 == 1 {
+		_, err := w.Write([]byte("\n"))
+		return err
+	}
+	return nil
+}
+
+func tarGz(modTime time.Time, write func(*tar.Writer) error) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.ModTime = modTime
+	tw := tar.NewWriter(gz)
+	if err := write(tw); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeTree adds files along with every directory leading to them
+func writeTree(tw *tar.Writer, files []File, modTime time.Time) error {
+	dirs := map[string]bool{}
+	for _, file := range files {
+		for dir := path.Dir(file.Path); dir != "/"; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	sortedDirs := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sortedDirs = append(sortedDirs, dir)
+	}
+	sort.Strings(sortedDirs)
+
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0755, ModTime: modTime, Format: tar.FormatGNU}); err != nil {
+		return err
+	}
+	for _, dir := range sortedDirs {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "." + dir + "/", Mode: 0755, ModTime: modTime, Format: tar.FormatGNU}); err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		if err := writeTarFile(tw, "."+file.Path, file.Data, int64(file.Mode), modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, mode int64, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     mode,
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+		Uname:    "root",
+		Gname:    "root",
+		Format:   tar.FormatGNU,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
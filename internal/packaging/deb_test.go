@@ -0,0 +1,143 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packaging
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type tarMember struct {
+	mode int64
+	data []byte
+}
+
+func readArMembers(t *testing.T, data []byte) ([]string, map[string][]byte) {
+	t.Helper()
+	if !bytes.HasPrefix(data, []byte("!<arch>\n")) {
+		t.Fatal("missing ar magic")
+	}
+	names := []string{}
+	members := map[string][]byte{}
+	for offset := 8; offset < len(data); {
+		header := string(data[offset : offset+60])
+		if header[58:] != "`\n" {
+			t.Fatalf("bad ar header terminator at %d", offset)
+		}
+		name := strings.TrimSpace(header[:16])
+		size, err := strconv.Atoi(strings.TrimSpace(header[48:58]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset += 60
+		names = append(names, name)
+		members[name] = data[offset : offset+size]
+		offset += size + size%2
+	}
+	return names, members
+}
+
+func readTarGz(t *testing.T, data []byte) map[string]tarMember {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	members := map[string]tarMember{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return members
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members[header.Name] = tarMember{mode: header.Mode, data: content}
+	}
+}
+
+func TestDeb(t *testing.T) {
+	spec := testSpec()
+	data, path := writePackage(t, &Deb{}, spec)
+
+	names, ar := readArMembers(t, data)
+	if strings.Join(names, " ") != "debian-binary control.tar.gz data.tar.gz" {
+		t.Fatalf("ar members = %v", names)
+	}
+	if string(ar["debian-binary"]) != "2.0\n" {
+		t.Errorf("debian-binary = %q", ar["debian-binary"])
+	}
+
+	control := readTarGz(t, ar["control.tar.gz"])
+	for _, field := range []string{
+		"Package: confiar-ca-test\n",
+		"Version: 20210102.030405-1\n",
+		"Architecture: all\n",
+		"Depends: ca-certificates\n",
+		"Description: Trusts the certificate authority test\n Adds the certificate authority test.\n .\n Second paragraph.\n",
+	} {
+		if !strings.Contains(string(control["./control"].data), field) {
+			t.Errorf("control is missing %q:\n%s", field, control["./control"].data)
+		}
+	}
+	for _, script := range []string{"./postinst", "./postrm"} {
+		if control[script].mode != 0755 {
+			t.Errorf("%s mode = %o", script, control[script].mode)
+		}
+	}
+
+	files := readTarGz(t, ar["data.tar.gz"])
+	md5sums := string(control["./md5sums"].data)
+	for _, file := range spec.Files {
+		member, ok := files["."+file.Path]
+		if !ok {
+			t.Fatalf("data.tar.gz is missing %s", file.Path)
+		}
+		if !bytes.Equal(member.data, file.Data) || member.mode != int64(file.Mode) {
+			t.Errorf("%s has mode %o and %q", file.Path, member.mode, member.data)
+		}
+		if sum := fmt.Sprintf("%x  %s\n", md5.Sum(file.Data), file.Path[1:]); !strings.Contains(md5sums, sum) {
+			t.Errorf("md5sums is missing %q", sum)
+		}
+	}
+	if _, ok := files["./usr/share/ca-certificates/confiar/"]; !ok {
+		t.Error("data.tar.gz is missing parent directories")
+	}
+
+	t.Run("dpkg-deb", func(t *testing.T) {
+		info := runTool(t, "dpkg-deb", "--info", path)
+		if !strings.Contains(info, "Package: confiar-ca-test") || !strings.Contains(info, "postinst") {
+			t.Errorf("dpkg-deb --info:\n%s", info)
+		}
+		contents := runTool(t, "dpkg-deb", "-c", path)
+		if !strings.Contains(contents, "./usr/share/ca-certificates/confiar/test.crt") {
+			t.Errorf("dpkg-deb -c:\n%s", contents)
+		}
+	})
+}
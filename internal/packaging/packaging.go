@@ -0,0 +1,78 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package packaging builds architecture independent .deb and .rpm packages
+// without dpkg-deb or rpmbuild.
+package packaging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+type File struct {
+	// Path is absolute
+	Path string
+	Data []byte
+	Mode os.FileMode
+}
+
+// Spec describes a package, formats take what they understand from it
+type Spec struct {
+	Name        string
+	Version     string
+	Release     string
+	Summary     string
+	Description string
+	Maintainer  string
+	License     string
+	Depends     []string
+
+	Files []File
+
+	// PostInstall and PostRemove are shell scripts run by the package manager
+	PostInstall string
+	PostRemove  string
+
+	// ModTime dates every file, for reproducible packages
+	ModTime time.Time
+}
+
+type Format interface {
+	Filename(spec *Spec) string
+	Write(w io.Writer, spec *Spec) error
+}
+
+func NewFormat(name string) (Format, error) {
+	switch name {
+	case "deb":
+		return &Deb{}, nil
+	case "rpm":
+		return &RPM{}, nil
+	default:
+		return nil, fmt.Errorf("unknown package format: %s", name)
+	}
+}
+
+func (s *Spec) installedSize() int64 {
+	var size int64
+	for _, file := range s.Files {
+		size += int64(len(file.Data))
+	}
+	return size
+}
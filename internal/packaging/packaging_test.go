@@ -0,0 +1,81 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packaging
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testCertData = "-----BEGIN CERTIFICATE-----\ntest\n-----END CERTIFICATE-----\n"
+
+func testSpec() *Spec {
+	return &Spec{
+		Name:        "confiar-ca-test",
+		Version:     "20210102.030405",
+		Release:     "1",
+		Summary:     "Trusts the certificate authority test",
+		Description: "Adds the certificate authority test.\n\nSecond paragraph.",
+		Maintainer:  "Tester <tester@example.com>",
+		Depends:     []string{"ca-certificates"},
+		Files: []File{
+			{Path: "/usr/share/ca-certificates/confiar/test.crt", Data: []byte(testCertData), Mode: 0644},
+			{Path: "/etc/confiar/other.crt", Data: []byte("odd length"), Mode: 0600},
+		},
+		PostInstall: "#!/bin/sh\necho installed\n",
+		PostRemove:  "#!/bin/sh\necho removed\n",
+		ModTime:     time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func writePackage(t *testing.T, format Format, spec *Spec) ([]byte, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := format.Write(&buf, spec); err != nil {
+		t.Fatal(err)
+	}
+	again := bytes.Buffer{}
+	if err := format.Write(&again, spec); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), again.Bytes()) {
+		t.Error("writing the same spec twice gave different packages")
+	}
+
+	path := filepath.Join(t.TempDir(), format.Filename(spec))
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), path
+}
+
+// runTool runs name with args, skipping the test when it is not installed
+func runTool(t *testing.T, name string, args ...string) string {
+	t.Helper()
+	if _, err := exec.LookPath(name); err != nil {
+		t.Skipf("%s not installed", name)
+	}
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s rejected the package: %v\n%s", name, err, out)
+	}
+	return string(out)
+}
@@ -0,0 +1,403 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packaging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// header tags, see rpmtag.h
+const (
+	rpmTagSignatures   = 62
+	rpmTagImmutable    = 63
+	rpmTagI18NTable    = 100
+	rpmSigTagSHA1      = 269
+	rpmSigTagSHA256    = 273
+	rpmSigTagSize      = 1000
+	rpmSigTagMD5       = 1004
+	rpmSigTagPayload   = 1007
+	rpmTagName         = 1000
+	rpmTagVersion      = 1001
+	rpmTagRelease      = 1002
+	rpmTagSummary      = 1004
+	rpmTagDescription  = 1005
+	rpmTagBuildTime    = 1006
+	rpmTagSize         = 1009
+	rpmTagLicense      = 1014
+	rpmTagPackager     = 1015
+	rpmTagGroup        = 1016
+	rpmTagOS           = 1021
+	rpmTagArch         = 1022
+	rpmTagPostIn       = 1024
+	rpmTagPostUn       = 1026
+	rpmTagFileSizes    = 1028
+	rpmTagFileModes    = 1030
+	rpmTagFileRdevs    = 1033
+	rpmTagFileMtimes   = 1034
+	rpmTagFileDigests  = 1035
+	rpmTagFileLinkTos  = 1036
+	rpmTagFileFlags    = 1037
+	rpmTagFileUserName = 1039
+	rpmTagFileGroup    = 1040
+	rpmTagSourceRPM    = 1044
+	rpmTagProvideName  = 1047
+	rpmTagRequireFlags = 1048
+	rpmTagRequireName  = 1049
+	rpmTagRequireVer   = 1050
+	rpmTagPostInProg   = 1086
+	rpmTagPostUnProg   = 1088
+	rpmTagFileDevices  = 1095
+	rpmTagFileInodes   = 1096
+	rpmTagFileLangs    = 1097
+	rpmTagProvideFlags = 1112
+	rpmTagProvideVer   = 1113
+	rpmTagDirIndexes   = 1116
+	rpmTagBaseNames    = 1117
+	rpmTagDirNames     = 1118
+	rpmTagPayloadFmt   = 1124
+	rpmTagPayloadComp  = 1125
+	rpmTagPayloadFlags = 1126
+	rpmTagPayloadHash  = 5092
+	rpmTagPayloadAlgo  = 5093
+	rpmTagFileHashAlgo = 5011
+)
+
+// header value types
+const (
+	rpmInt16       = 3
+	rpmInt32       = 4
+	rpmString      = 6
+	rpmBin         = 7
+	rpmStringArray = 8
+	rpmI18NString  = 9
+)
+
+const (
+	rpmSenseLess   = 1 << 1
+	rpmSenseEqual  = 1 << 3
+	rpmSenseRPMLib = 1 << 24
+
+	// PGPHASHALGO_SHA256
+	rpmHashSHA256 = 8
+)
+
+var rpmHeaderMagic = []byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0}
+
+// RPM writes binary packages in the version 3 lead and version 4 header
+// format understood by every rpm since 4.6
+type RPM struct{}
+
+func (r *RPM) Filename(spec *Spec) string {
+	return fmt.Sprintf("%s-%s.noarch.rpm", spec.Name, r.versionRelease(spec))
+}
+
+func (r *RPM) versionRelease(spec *Spec) string {
+	return spec.Version + "-" + r.release(spec)
+}
+
+func (r *RPM) release(spec *Spec) string {
+	if spec.Release == "" {
+		return "1"
+	}
+	return spec.Release
+}
+
+func (r *RPM) Write(w io.Writer, spec *Spec) error {
+	payload, payloadSize, err := rpmPayload(spec)
+	if err != nil {
+		return err
+	}
+	header := r.header(spec, payload).marshal(rpmTagImmutable)
+
+	signed := append(append([]byte{}, header...), payload...)
+	sha1Sum := sha1.Sum(header)
+	sha256Sum := sha256.Sum256(header)
+	md5Sum := md5.Sum(signed)
+	signature := &rpmHeader{}
+	signature.add(rpmSigTagSHA1, rpmString, hex.EncodeToString(sha1Sum[:]))
+	signature.add(rpmSigTagSHA256, rpmString, hex.EncodeToString(sha256Sum[:]))
+	signature.add(rpmSigTagSize, rpmInt32, []uint32{uint32(len(signed))})
+	signature.add(rpmSigTagMD5, rpmBin, md5Sum[:])
+	signature.add(rpmSigTagPayload, rpmInt32, []uint32{uint32(payloadSize)})
+	sigBytes := signature.marshal(rpmTagSignatures)
+	// the main header starts 8-byte aligned
+	sigBytes = append(sigBytes, make([]byte, (8-len(sigBytes)%8)%8)...)
+
+	for _, chunk := range [][]byte{r.lead(spec), sigBytes, signed} {
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lead is only kept for file(1) and ancient tools, rpm reads the headers
+func (r *RPM) lead(spec *Spec) []byte {
+	lead := make([]byte, 96)
+	copy(lead, []byte{0xed, 0xab, 0xee, 0xdb, 3, 0})
+	name := fmt.Sprintf("%s-%s", spec.Name, r.versionRelease(spec))
+	if len(name) > 65 {
+		name = name[:65]
+	}
+	copy(lead[10:76], name)
+	binary.BigEndian.PutUint16(lead[76:], 1) // osnum: linux
+	binary.BigEndian.PutUint16(lead[78:], 5) // signature type: header style
+	return lead
+}
+
+func (r *RPM) header(spec *Spec, payload []byte) *rpmHeader {
+	files := append([]File{}, spec.Files...)
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	var (
+		sizes, mtimes, flags, devices, inodes, dirIndexes []uint32
+		modes, rdevs                                      []uint16
+		digests, linkTos, users, groups, langs, baseNames []string
+		dirNames                                          []string
+	)
+	dirIndex := map[string]uint32{}
+	for i, file := range files {
+		dir := path.Dir(file.Path) + "/"
+		if _, ok := dirIndex[dir]; !ok {
+			dirIndex[dir] = uint32(len(dirNames))
+			dirNames = append(dirNames, dir)
+		}
+		digest := sha256.Sum256(file.Data)
+		sizes = append(sizes, uint32(len(file.Data)))
+		mtimes = append(mtimes, uint32(spec.ModTime.Unix()))
+		flags = append(flags, 0)
+		devices = append(devices, 1)
+		inodes = append(inodes, uint32(i+1))
+		dirIndexes = append(dirIndexes, dirIndex[dir])
+		modes = append(modes, uint16(0100000|file.Mode.Perm()))
+		rdevs = append(rdevs, 0)
+		digests = append(digests, hex.EncodeToString(digest[:]))
+		linkTos = append(linkTos, "")
+		users = append(users, "root")
+		groups = append(groups, "root")
+		langs = append(langs, "")
+		baseNames = append(baseNames, path.Base(file.Path))
+	}
+
+	requireNames := []string{}
+	requireFlags := []uint32{}
+	requireVersions := []string{}
+	for _, depend := range spec.Depends {
+		requireNames = append(requireNames, depend)
+		requireFlags = append(requireFlags, 0)
+		requireVersions = append(requireVersions, "")
+	}
+	for _, feature := range [][2]string{
+		{"rpmlib(CompressedFileNames)", "3.0.4-1"},
+		{"rpmlib(FileDigests)", "4.6.0-1"},
+		{"rpmlib(PayloadFilesHavePrefix)", "4.0-1"},
+	} {
+		requireNames = append(requireNames, feature[0])
+		requireFlags = append(requireFlags, rpmSenseRPMLib|rpmSenseLess|rpmSenseEqual)
+		requireVersions = append(requireVersions, feature[1])
+	}
+
+	payloadDigest := sha256.Sum256(payload)
+	license := spec.License
+	if license == "" {
+		license = "Public Domain"
+	}
+
+	h := &rpmHeader{}
+	h.add(rpmTagI18NTable, rpmStringArray, []string{"C"})
+	h.add(rpmTagName, rpmString, spec.Name)
+	h.add(rpmTagVersion, rpmString, spec.Version)
+	h.add(rpmTagRelease, rpmString, r.release(spec))
+	h.add(rpmTagSummary, rpmI18NString, spec.Summary)
+	h.add(rpmTagDescription, rpmI18NString, strings.TrimSpace(spec.Description))
+	h.add(rpmTagBuildTime, rpmInt32, []uint32{uint32(spec.ModTime.Unix())})
+	h.add(rpmTagSize, rpmInt32, []uint32{uint32(spec.installedSize())})
+	h.add(rpmTagLicense, rpmString, license)
+	if spec.Maintainer != "" {
+		h.add(rpmTagPackager, rpmString, spec.Maintainer)
+	}
+	h.add(rpmTagGroup, rpmI18NString, "System Environment/Base")
+	h.add(rpmTagOS, rpmString, "linux")
+	h.add(rpmTagArch, rpmString, "noarch")
+	if spec.PostInstall != "" {
+		h.add(rpmTagPostIn, rpmString, spec.PostInstall)
+		h.add(rpmTagPostInProg, rpmStringArray, []string{"/bin/sh"})
+	}
+	if spec.PostRemove != "" {
+		h.add(rpmTagPostUn, rpmString, spec.PostRemove)
+		h.add(rpmTagPostUnProg, rpmStringArray, []string{"/bin/sh"})
+	}
+	h.add(rpmTagFileSizes, rpmInt32, sizes)
+	h.add(rpmTagFileModes, rpmInt16, modes)
+	h.add(rpmTagFileRdevs, rpmInt16, rdevs)
+	h.add(rpmTagFileMtimes, rpmInt32, mtimes)
+	h.add(rpmTagFileDigests, rpmStringArray, digests)
+	h.add(rpmTagFileLinkTos, rpmStringArray, linkTos)
+	h.add(rpmTagFileFlags, rpmInt32, flags)
+	h.add(rpmTagFileUserName, rpmStringArray, users)
+	h.add(rpmTagFileGroup, rpmStringArray, groups)
+	// without a source package rpm would take this for one
+	h.add(rpmTagSourceRPM, rpmString, fmt.Sprintf("%s-%s.src.rpm", spec.Name, r.versionRelease(spec)))
+	h.add(rpmTagProvideName, rpmStringArray, []string{spec.Name})
+	h.add(rpmTagRequireFlags, rpmInt32, requireFlags)
+	h.add(rpmTagRequireName, rpmStringArray, requireNames)
+	h.add(rpmTagRequireVer, rpmStringArray, requireVersions)
+	h.add(rpmTagFileDevices, rpmInt32, devices)
+	h.add(rpmTagFileInodes, rpmInt32, inodes)
+	h.add(rpmTagFileLangs, rpmStringArray, langs)
+	h.add(rpmTagProvideFlags, rpmInt32, []uint32{rpmSenseEqual})
+	h.add(rpmTagProvideVer, rpmStringArray, []string{r.versionRelease(spec)})
+	h.add(rpmTagDirIndexes, rpmInt32, dirIndexes)
+	h.add(rpmTagBaseNames, rpmStringArray, baseNames)
+	h.add(rpmTagDirNames, rpmStringArray, dirNames)
+	h.add(rpmTagPayloadFmt, rpmString, "cpio")
+	h.add(rpmTagPayloadComp, rpmString, "gzip")
+	h.add(rpmTagPayloadFlags, rpmString, "9")
+	h.add(rpmTagFileHashAlgo, rpmInt32, []uint32{rpmHashSHA256})
+	h.add(rpmTagPayloadHash, rpmStringArray, []string{hex.EncodeToString(payloadDigest[:])})
+	h.add(rpmTagPayloadAlgo, rpmInt32, []uint32{rpmHashSHA256})
+	return h
+}
+
+// rpmPayload is a gzipped cpio archive in the "new ASCII" format, also
+// returning its uncompressed size
+func rpmPayload(spec *Spec) ([]byte, int, error) {
+	var archive bytes.Buffer
+	for i, file := range spec.Files {
+		writeCpioEntry(&archive, "."+file.Path, file.Data, uint32(i+1), 0100000|uint32(file.Mode.Perm()), 1, uint32(spec.ModTime.Unix()))
+	}
+	writeCpioEntry(&archive, "TRAILER!!!", nil, 0, 0, 1, 0)
+
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, 0, err
+	}
+	gz.ModTime = spec.ModTime
+	if _, err := gz.Write(archive.Bytes()); err != nil {
+		return nil, 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), archive.Len(), nil
+}
+
+func writeCpioEntry(w *bytes.Buffer, name string, data []byte, inode, mode, nlink, mtime uint32) {
+	fmt.Fprintf(w, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		inode, mode, 0, 0, nlink, mtime, len(data), 0, 1, 0, 0, len(name)+1, 0)
+	w.WriteString(name)
+	w.WriteByte(0)
+	cpioPad(w)
+	w.Write(data)
+	cpioPad(w)
+}
+
+func cpioPad(w *bytes.Buffer) {
+	for w.Len()%4 != 0 {
+		w.WriteByte(0)
+	}
+}
+
+type rpmEntry struct {
+	tag   uint32
+	typ   uint32
+	value interface{}
+}
+
+type rpmHeader struct {
+	entries []rpmEntry
+}
+
+func (h *rpmHeader) add(tag uint32, typ uint32, value interface{}) {
+	h.entries = append(h.entries, rpmEntry{tag: tag, typ: typ, value: value})
+}
+
+// marshal lays out the index sorted by tag with data in the same order, as rpm
+// rejects headers whose data goes backwards, enclosed in region
+func (h *rpmHeader) marshal(region uint32) []byte {
+	entries := append([]rpmEntry{}, h.entries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	var index, store bytes.Buffer
+	writeIndex := func(tag, typ uint32, offset int32, count uint32) {
+		binary.Write(&index, binary.BigEndian, []uint32{tag, typ, uint32(offset), count})
+	}
+	for _, entry := range entries {
+		var count uint32
+		switch value := entry.value.(type) {
+		case string:
+			offset := store.Len()
+			store.WriteString(value)
+			store.WriteByte(0)
+			writeIndex(entry.tag, entry.typ, int32(offset), 1)
+			continue
+		case []string:
+			offset := store.Len()
+			for _, s := range value {
+				store.WriteString(s)
+				store.WriteByte(0)
+			}
+			writeIndex(entry.tag, entry.typ, int32(offset), uint32(len(value)))
+			continue
+		case []byte:
+			offset := store.Len()
+			store.Write(value)
+			writeIndex(entry.tag, entry.typ, int32(offset), uint32(len(value)))
+			continue
+		case []uint16:
+			alignBuffer(&store, 2)
+			count = uint32(len(value))
+		case []uint32:
+			alignBuffer(&store, 4)
+			count = uint32(len(value))
+		}
+		offset := store.Len()
+		binary.Write(&store, binary.BigEndian, entry.value)
+		writeIndex(entry.tag, entry.typ, int32(offset), count)
+	}
+
+	// the region tag comes first and points at a trailer which claims the
+	// whole index as part of the region by its negative offset
+	trailerOffset := store.Len()
+	binary.Write(&store, binary.BigEndian, []uint32{region, rpmBin, uint32(int32(-16 * (len(entries) + 1))), 16})
+
+	var out bytes.Buffer
+	out.Write(rpmHeaderMagic)
+	binary.Write(&out, binary.BigEndian, []uint32{uint32(len(entries) + 1), uint32(store.Len())})
+	binary.Write(&out, binary.BigEndian, []uint32{region, rpmBin, uint32(trailerOffset), 16})
+	out.Write(index.Bytes())
+	out.Write(store.Bytes())
+	return out.Bytes()
+}
+
+func alignBuffer(buf *bytes.Buffer, n int) {
+	for buf.Len()%n != 0 {
+		buf.WriteByte(0)
+	}
+}
@@ -0,0 +1,242 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packaging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type rpmValue struct {
+	typ     uint32
+	strings []string
+	ints    []uint32
+	raw     []byte
+}
+
+// readRPMHeader parses the header at offset, checking what rpm's
+// hdrblobVerifyInfo and hdrblobVerifyRegion check, and returns it along with
+// its end
+func readRPMHeader(t *testing.T, data []byte, offset int, region uint32) (map[uint32]rpmValue, int) {
+	t.Helper()
+	if !bytes.Equal(data[offset:offset+8], rpmHeaderMagic) {
+		t.Fatalf("missing header magic at %d", offset)
+	}
+	count := int(binary.BigEndian.Uint32(data[offset+8:]))
+	size := int(binary.BigEndian.Uint32(data[offset+12:]))
+	index := data[offset+16 : offset+16+16*count]
+	store := data[offset+16+16*count : offset+16+16*count+size]
+
+	entry := func(i int) (uint32, uint32, int32, uint32) {
+		e := index[16*i:]
+		return binary.BigEndian.Uint32(e), binary.BigEndian.Uint32(e[4:]), int32(binary.BigEndian.Uint32(e[8:])), binary.BigEndian.Uint32(e[12:])
+	}
+	tag, typ, trailerOffset, n := entry(0)
+	if tag != region || typ != rpmBin || n != 16 || int(trailerOffset) != size-16 {
+		t.Fatalf("region entry = %d %d %d %d", tag, typ, trailerOffset, n)
+	}
+	trailer := store[trailerOffset:]
+	if binary.BigEndian.Uint32(trailer) != region || int32(binary.BigEndian.Uint32(trailer[8:])) != int32(-16*count) {
+		t.Fatalf("region trailer does not cover the index: %x", trailer)
+	}
+
+	values := map[uint32]rpmValue{}
+	end, lastTag := 0, uint32(0)
+	for i := 1; i < count; i++ {
+		tag, typ, off, n := entry(i)
+		if tag < lastTag {
+			t.Errorf("tag %d is out of order", tag)
+		}
+		lastTag = tag
+		if int(off) < end {
+			t.Errorf("tag %d data at %d overlaps previous ending at %d", tag, off, end)
+		}
+		value := rpmValue{typ: typ}
+		switch typ {
+		case rpmString, rpmStringArray, rpmI18NString:
+			p := int(off)
+			for j := uint32(0); j < n; j++ {
+				k := bytes.IndexByte(store[p:], 0)
+				value.strings = append(value.strings, string(store[p:p+k]))
+				p += k + 1
+			}
+			end = p
+		case rpmInt16:
+			if off%2 != 0 {
+				t.Errorf("tag %d is misaligned", tag)
+			}
+			for j := 0; j < int(n); j++ {
+				value.ints = append(value.ints, uint32(binary.BigEndian.Uint16(store[int(off)+2*j:])))
+			}
+			end = int(off) + 2*int(n)
+		case rpmInt32:
+			if off%4 != 0 {
+				t.Errorf("tag %d is misaligned", tag)
+			}
+			for j := 0; j < int(n); j++ {
+				value.ints = append(value.ints, binary.BigEndian.Uint32(store[int(off)+4*j:]))
+			}
+			end = int(off) + 4*int(n)
+		case rpmBin:
+			value.raw = store[off : int(off)+int(n)]
+			end = int(off) + int(n)
+		default:
+			t.Fatalf("tag %d has unexpected type %d", tag, typ)
+		}
+		if end > size-16 {
+			t.Errorf("tag %d data runs into the region trailer", tag)
+		}
+		values[tag] = value
+	}
+	return values, offset + 16 + 16*count + size
+}
+
+// readCpio returns the regular files of a newc archive by name
+func readCpio(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+	files := map[string][]byte{}
+	align := func(n int) int { return (n + 3) &^ 3 }
+	for offset := 0; ; {
+		header := string(data[offset : offset+110])
+		if header[:6] != "070701" {
+			t.Fatalf("bad cpio magic at %d", offset)
+		}
+		field := func(i int) int {
+			v, err := strconv.ParseUint(header[6+8*i:14+8*i], 16, 32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return int(v)
+		}
+		size, nameSize := field(6), field(11)
+		name := string(data[offset+110 : offset+110+nameSize-1])
+		offset = align(offset + 110 + nameSize)
+		if name == "TRAILER!!!" {
+			return files
+		}
+		files[name] = data[offset : offset+size]
+		offset = align(offset + size)
+	}
+}
+
+func TestRPM(t *testing.T) {
+	spec := testSpec()
+	data, path := writePackage(t, &RPM{}, spec)
+
+	if !bytes.Equal(data[:4], []byte{0xed, 0xab, 0xee, 0xdb}) {
+		t.Fatal("missing lead magic")
+	}
+	signature, end := readRPMHeader(t, data, 96, rpmTagSignatures)
+	start := end + (8-end%8)%8
+	header, payloadStart := readRPMHeader(t, data, start, rpmTagImmutable)
+	headerBytes := data[start:payloadStart]
+	payload := data[payloadStart:]
+
+	sha1Sum := sha1.Sum(headerBytes)
+	sha256Sum := sha256.Sum256(headerBytes)
+	md5Sum := md5.Sum(data[start:])
+	if got := signature[rpmSigTagSHA1].strings[0]; got != hex.EncodeToString(sha1Sum[:]) {
+		t.Errorf("signature SHA1 = %s", got)
+	}
+	if got := signature[rpmSigTagSHA256].strings[0]; got != hex.EncodeToString(sha256Sum[:]) {
+		t.Errorf("signature SHA256 = %s", got)
+	}
+	if got := signature[rpmSigTagMD5].raw; !bytes.Equal(got, md5Sum[:]) {
+		t.Errorf("signature MD5 = %x", got)
+	}
+	if got := signature[rpmSigTagSize].ints[0]; int(got) != len(data)-start {
+		t.Errorf("signature size = %d, want %d", got, len(data)-start)
+	}
+
+	for tag, want := range map[uint32]string{
+		rpmTagName:       "confiar-ca-test",
+		rpmTagVersion:    "20210102.030405",
+		rpmTagRelease:    "1",
+		rpmTagArch:       "noarch",
+		rpmTagOS:         "linux",
+		rpmTagSourceRPM:  "confiar-ca-test-20210102.030405-1.src.rpm",
+		rpmTagPostIn:     spec.PostInstall,
+		rpmTagPostUn:     spec.PostRemove,
+		rpmTagPayloadFmt: "cpio",
+	} {
+		if got := header[tag].strings; len(got) != 1 || got[0] != want {
+			t.Errorf("tag %d = %q, want %q", tag, got, want)
+		}
+	}
+	if got := strings.Join(header[rpmTagRequireName].strings, " "); !strings.HasPrefix(got, "ca-certificates rpmlib(") {
+		t.Errorf("requires = %s", got)
+	}
+
+	payloadSum := sha256.Sum256(payload)
+	if got := header[rpmTagPayloadHash].strings[0]; got != hex.EncodeToString(payloadSum[:]) {
+		t.Errorf("payload digest = %s", got)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := signature[rpmSigTagPayload].ints[0]; int(got) != len(archive) {
+		t.Errorf("signature payload size = %d, want %d", got, len(archive))
+	}
+	cpioFiles := readCpio(t, archive)
+
+	// files are listed sorted by path, split into directory and base name
+	dirNames := header[rpmTagDirNames].strings
+	for i, baseName := range header[rpmTagBaseNames].strings {
+		name := dirNames[header[rpmTagDirIndexes].ints[i]] + baseName
+		content, ok := cpioFiles["."+name]
+		if !ok {
+			t.Errorf("payload is missing %s", name)
+			continue
+		}
+		digest := sha256.Sum256(content)
+		if header[rpmTagFileDigests].strings[i] != hex.EncodeToString(digest[:]) {
+			t.Errorf("digest of %s does not match the payload", name)
+		}
+		if int(header[rpmTagFileSizes].ints[i]) != len(content) {
+			t.Errorf("size of %s does not match the payload", name)
+		}
+	}
+	if got := header[rpmTagFileModes].ints; got[0] != 0100600 || got[1] != 0100644 {
+		t.Errorf("file modes = %o", got)
+	}
+
+	t.Run("rpm", func(t *testing.T) {
+		runTool(t, "rpm", "--checksig", path)
+		info := runTool(t, "rpm", "-qpi", path)
+		if !strings.Contains(info, "confiar-ca-test") {
+			t.Errorf("rpm -qpi:\n%s", info)
+		}
+		list := runTool(t, "rpm", "-qpl", path)
+		if !strings.Contains(list, "/usr/share/ca-certificates/confiar/test.crt") {
+			t.Errorf("rpm -qpl:\n%s", list)
+		}
+	})
+}
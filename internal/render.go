@@ -0,0 +1,206 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/wilsonehusin/confiar/internal/certs"
+	"github.com/wilsonehusin/confiar/internal/target"
+)
+
+// ignitionVersion is the config spec understood by Fedora CoreOS since 39
+const ignitionVersion = "3.4.0"
+
+const ignitionUpdateUnit = "confiar-update-ca-trust.service"
+
+type RenderConfig struct {
+	CertSrc    string
+	ExtraNames []string
+	ExtraIPs   []string
+
+	// Docker also provisions the certificate for Docker, by hostname
+	Docker bool
+}
+
+type cloudConfig struct {
+	CACerts    cloudCACerts `yaml:"ca_certs"`
+	WriteFiles []cloudFile  `yaml:"write_files,omitempty"`
+}
+
+type cloudCACerts struct {
+	Trusted []string `yaml:"trusted"`
+}
+
+type cloudFile struct {
+	Path        string `yaml:"path"`
+	Content     string `yaml:"content"`
+	Owner       string `yaml:"owner"`
+	Permissions string `yaml:"permissions"`
+}
+
+// RenderCloudInit writes cloud-config which trusts the certificate through
+// the ca_certs module at first boot.
+func RenderCloudInit(config *RenderConfig, w io.Writer) error {
+	certBytes, dockerPaths, err := renderInputs(config)
+	if err != nil {
+		return err
+	}
+
+	document := cloudConfig{CACerts: cloudCACerts{Trusted: []string{string(certBytes)}}}
+	for _, dockerPath := range dockerPaths {
+		document.WriteFiles = append(document.WriteFiles, cloudFile{
+			Path:        dockerPath,
+			Content:     string(certBytes),
+			Owner:       "root:root",
+			Permissions: "0644",
+		})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("#cloud-config\n")
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(document); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+type ignitionConfig struct {
+	Ignition ignitionMeta    `json:"ignition"`
+	Storage  ignitionStorage `json:"storage"`
+	Systemd  ignitionSystemd `json:"systemd"`
+}
+
+type ignitionMeta struct {
+	Version string `json:"version"`
+}
+
+type ignitionStorage struct {
+	Files []ignitionFile `json:"files"`
+}
+
+type ignitionFile struct {
+	Path     string           `json:"path"`
+	Mode     int              `json:"mode"`
+	Contents ignitionContents `json:"contents"`
+}
+
+type ignitionContents struct {
+	Source string `json:"source"`
+}
+
+type ignitionSystemd struct {
+	Units []ignitionUnit `json:"units"`
+}
+
+type ignitionUnit struct {
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	Contents string `json:"contents"`
+}
+
+// RenderIgnition writes an Ignition config for Fedora CoreOS which places the
+// certificate in the trust store anchors, along with a unit compiling them
+// into the bundle before container engines start.
+func RenderIgnition(config *RenderConfig, w io.Writer) error {
+	certBytes, dockerPaths, err := renderInputs(config)
+	if err != nil {
+		return err
+	}
+	certData, err := certs.ParsePEM(certBytes)
+	if err != nil {
+		return err
+	}
+	anchor, err := target.NewTrustAnchor("fedora", certData)
+	if err != nil {
+		return err
+	}
+
+	source := "data:;base64," + base64.StdEncoding.EncodeToString(certBytes)
+	files := []ignitionFile{{Path: anchor.Path, Mode: 0644, Contents: ignitionContents{Source: source}}}
+	for _, dockerPath := range dockerPaths {
+		files = append(files, ignitionFile{Path: dockerPath, Mode: 0644, Contents: ignitionContents{Source: source}})
+	}
+
+	unit := strings.Join([]string{
+		"[Unit]",
+		"Description=Add certificates installed by confiar to the trust store",
+		"ConditionPathExists=" + anchor.Path,
+		"After=local-fs.target",
+		"Before=docker.service containerd.service crio.service podman.service",
+		"",
+		"[Service]",
+		"Type=oneshot",
+		"ExecStart=/usr/bin/" + strings.Join(anchor.UpdateCommand, " "),
+		"RemainAfterExit=yes",
+		"",
+		"[Install]",
+		"WantedBy=multi-user.target",
+		"",
+	}, "\n")
+
+	document := ignitionConfig{
+		Ignition: ignitionMeta{Version: ignitionVersion},
+		Storage:  ignitionStorage{Files: files},
+		Systemd: ignitionSystemd{Units: []ignitionUnit{
+			{Name: ignitionUpdateUnit, Enabled: true, Contents: unit},
+		}},
+	}
+	data, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// renderInputs returns the certificate as PEM and, when asked for, where
+// Docker expects it
+func renderInputs(config *RenderConfig) ([]byte, []string, error) {
+	fetched, err := fetchCertificate(config.CertSrc, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fetched.cleanup()
+	certBytes, err := os.ReadFile(fetched.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	certData, err := certs.ParsePEM(certBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse certificate: %w", err)
+	}
+
+	if !config.Docker {
+		return certBytes, nil, nil
+	}
+	return certBytes, target.DockerCertPaths(certData, append(config.ExtraNames, config.ExtraIPs...)), nil
+}
@@ -0,0 +1,84 @@
+/*
+Copyright © 2021 Wilson Husin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const issuePath = "/issue"
+
+// RequestTLS asks the server at issuerSrc to sign a certificate for names and
+// ips, the private key never leaves this host.
+func RequestTLS(backendType string, issuerSrc string, token string, names []string, ips []string, outDir string) error {
+	issueURL, err := url.Parse(issuerSrc)
+	if err != nil {
+		return fmt.Errorf("invalid issuer address: %w", err)
+	}
+	if !strings.HasSuffix(issueURL.Path, issuePath) {
+		issueURL.Path = path.Join("/", issueURL.Path, issuePath)
+	}
+
+	backend, err := newCryptographer(backendType)
+	if err != nil {
+		return err
+	}
+	csrBytes, err := backend.NewTLSCertificateRequest(names, ips)
+	if err != nil {
+		return err
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes})
+
+	req, err := http.NewRequest(http.MethodPost, issueURL.String(), bytes.NewReader(csrPEM))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/pkcs10")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	log.Info().Stringer("issuer", issueURL).Msg("requesting certificate")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to request certificate: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRequestBytes))
+	if err != nil {
+		return fmt.Errorf("unable to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("issuer responded with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	certBlock, _ := pem.Decode(body)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return fmt.Errorf("issuer did not respond with a PEM encoded certificate")
+	}
+	return backend.WriteTLSCertificate(certBlock.Bytes, outDir)
+}
@@ -17,31 +17,462 @@ limitations under the License.
 package internal
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+
+	"github.com/wilsonehusin/confiar/internal/audit"
+	"github.com/wilsonehusin/confiar/internal/certs"
+	"github.com/wilsonehusin/confiar/internal/cryptographer"
+	"github.com/wilsonehusin/confiar/internal/metrics"
 )
 
-func ServeCertificate(path string, port int) error {
-	log.Debug().Str("CertPath", path).Int("Port", port).Msg("setting up server")
+// maximum accepted size of a certificate signing request
+const maxRequestBytes = 64 * 1024
+
+type ServeConfig struct {
+	CertPath string
+	Port     int
+
+	// issuance is only enabled when both KeyPath and Token are set
+	KeyPath string
+	Token   string
+
+	// health and metrics endpoints are served on the certificate port, unless
+	// MetricsAddr is given
+	MetricsAddr string
+	// MetricsClientLabel adds the client address to download metrics, which
+	// makes one series per client
+	MetricsClientLabel bool
+}
+
+// downloadPaths are counted by their own path, anything else the catch-all
+// route answers is counted as other
+var downloadPaths = map[string]bool{
+	"/":         true,
+	"/cert.pem": true,
+}
+
+type certServer struct {
+	config *ServeConfig
 
-	cert, err := os.ReadFile(path)
+	mu     sync.RWMutex
+	served *servedCert
+
+	issuer cryptographer.Cryptographer
+
+	downloads *metrics.CounterVec
+	errors    *metrics.CounterVec
+	issuance  *metrics.CounterVec
+}
+
+func ServeCertificate(config *ServeConfig) error {
+	log.Debug().Str("CertPath", config.CertPath).Int("Port", config.Port).Msg("setting up server")
+
+	s, err := newCertServer(config)
 	if err != nil {
-		log.Fatal().Err(err).Msg("unable to open certificate")
+		return err
+	}
+	mux, opsMux := s.handlers()
+
+	errCh := make(chan error, 2)
+	if config.MetricsAddr != "" {
+		go func() {
+			log.Info().Str("MetricsAddr", config.MetricsAddr).Msg("listening for metrics requests")
+			errCh <- http.ListenAndServe(config.MetricsAddr, opsMux)
+		}()
+	}
+	go func() {
+		log.Info().Int("Port", config.Port).Msg("listening for requests")
+		errCh <- http.ListenAndServe(fmt.Sprintf(":%d", config.Port), mux)
+	}()
+	return <-errCh
+}
+
+func newCertServer(config *ServeConfig) (*certServer, error) {
+	s := &certServer{
+		config: config,
+	}
+	if config.KeyPath != "" {
+		if config.Token == "" {
+			return nil, fmt.Errorf("refusing to issue certificates without a token")
+		}
+		issuer, err := newCryptographer("gostd")
+		if err != nil {
+			return nil, err
+		}
+		s.issuer = issuer
+	}
+
+	// the certificate authority is loaded along with the certificate
+	if _, err := s.reload(); err != nil {
+		return nil, fmt.Errorf("unable to open certificate: %w", err)
+	}
+	if config.KeyPath != "" {
+		log.Info().Str("KeyPath", config.KeyPath).Msg("certificate issuance enabled")
+	}
+	return s, nil
+}
+
+// handlers returns the certificate handler and the one for health and
+// metrics, which are the same unless MetricsAddr is set
+func (s *certServer) handlers() (*http.ServeMux, *http.ServeMux) {
+	mux := http.NewServeMux()
+	mux.Handle("/issue", s.instrument("/issue", s.handleIssue))
+	mux.Handle("/", s.instrument("/", s.handleCertificate))
+
+	opsMux := mux
+	if s.config.MetricsAddr != "" {
+		opsMux = http.NewServeMux()
 	}
+	opsMux.Handle("/metrics", s.newRegistry())
+	opsMux.HandleFunc("/healthz", s.handleHealthz)
+	opsMux.HandleFunc("/readyz", s.handleReadyz)
+	return mux, opsMux
+}
+
+type servedCert struct {
+	data    []byte
+	parsed  *x509.Certificate
+	modTime time.Time
+	etag    string
+
+	// caKey signs issued certificates, when issuance is enabled
+	caKey crypto.Signer
+}
+
+func (s *certServer) current() *servedCert {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.served
+}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.Info().
-			Str("method", r.Method).
-			Stringer("url", r.URL).
-			Str("host", r.Host).
-			Str("remote", r.RemoteAddr).
-			Send()
-		w.Write(cert)
+// reload reads the certificate again if it was modified since last read, so
+// it can be replaced without restarting the server. When issuing certificates
+// the private key is read again too, and the new certificate is only served
+// once it matches, so that issued certificates always chain to the served one.
+func (s *certServer) reload() (*servedCert, error) {
+	info, err := os.Stat(s.config.CertPath)
+	if err != nil {
+		return s.current(), err
+	}
+	if served := s.current(); served != nil && served.modTime.Equal(info.ModTime()) {
+		return served, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.config.CertPath)
+	if err != nil {
+		return s.served, err
+	}
+	served := &servedCert{
+		data:    data,
+		modTime: info.ModTime(),
+	}
+	sum := sha256.Sum256(data)
+	served.etag = fmt.Sprintf(`"%x"`, sum)
+	served.parsed, err = certs.ParsePEM(data)
+	if err != nil {
+		log.Warn().Err(err).Msg("unable to parse certificate")
+	}
+	if s.config.KeyPath != "" {
+		served.caKey, err = loadAuthority(served.parsed, s.config.KeyPath)
+		if err != nil {
+			return s.served, fmt.Errorf("unable to load certificate authority: %w", err)
+		}
+	}
+	if served.parsed != nil {
+		log.Info().Str("fingerprint", certs.Fingerprint(served.parsed.Raw)).Time("modTime", served.modTime).Msg("loaded certificate")
+	}
+	s.served = served
+	return served, nil
+}
+
+func (s *certServer) newRegistry() *metrics.Registry {
+	registry := metrics.NewRegistry()
+	registry.NewConstGauge("confiar_build_info", "Build information of the running confiar.", 1, map[string]string{
+		"version": Version,
+		"gitsha":  GitSHA,
+		"go":      Go,
 	})
+	registry.NewGaugeFunc("confiar_certificate_expiry_seconds", "Seconds until the served certificate expires.", func() (float64, bool) {
+		certData := s.current().parsed
+		if certData == nil {
+			return 0, false
+		}
+		return time.Until(certData.NotAfter).Seconds(), true
+	})
+	downloadLabels := []string{"path"}
+	if s.config.MetricsClientLabel {
+		downloadLabels = append(downloadLabels, "client")
+	}
+	s.downloads = registry.NewCounterVec("confiar_downloads_total", "Certificate downloads by path, HEAD requests and 304 revalidations are not counted.", downloadLabels...)
+	s.errors = registry.NewCounterVec("confiar_errors_total", "Requests answered with an error status code.", "path", "code")
+	s.issuance = registry.NewCounterVec("confiar_issued_certificates_total", "Certificate issuance requests by result.", "result")
+	return registry
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (s *certServer) instrument(path string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, r)
+		if recorder.status >= http.StatusBadRequest {
+			s.errors.Inc(path, fmt.Sprint(recorder.status))
+		}
+	})
+}
 
-	log.Info().Int("Port", port).Msg("listening for requests")
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+func (s *certServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz checks the certificate on disk, which is what the next
+// download will be answered with
+func (s *certServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	served, err := s.reload()
+	switch {
+	case err != nil:
+		log.Warn().Err(err).Msg("unable to reload certificate")
+		http.Error(w, "certificate could not be loaded", http.StatusServiceUnavailable)
+	case served.parsed == nil:
+		http.Error(w, "certificate could not be parsed", http.StatusServiceUnavailable)
+	case time.Now().After(served.parsed.NotAfter):
+		http.Error(w, "certificate has expired", http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// loadAuthority reads the private key of caCert from keyPath
+func loadAuthority(caCert *x509.Certificate, keyPath string) (crypto.Signer, error) {
+	if caCert == nil {
+		return nil, fmt.Errorf("failed to parse certificate")
+	}
+	if !caCert.IsCA {
+		return nil, fmt.Errorf("certificate is not a certificate authority")
+	}
+
+	keyBytes, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyBytes)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("failed to parse private key PEM")
+	}
+	var key interface{}
+	switch keyBlock.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(keyBlock.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	// certificate and key are replaced one after the other
+	public, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !public.Equal(caCert.PublicKey) {
+		return nil, fmt.Errorf("private key does not match the certificate")
+	}
+	return signer, nil
+}
+
+func (s *certServer) handleCertificate(w http.ResponseWriter, r *http.Request) {
+	logRequest(r).Send()
+
+	served, err := s.reload()
+	if err != nil {
+		// keep serving what we have rather than failing clients
+		log.Error().Err(err).Msg("unable to reload certificate")
+	}
+
+	// ServeContent answers If-None-Match and If-Modified-Since with 304
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	recorder.Header().Set("ETag", served.etag)
+	http.ServeContent(recorder, r, "cert.pem", served.modTime, bytes.NewReader(served.data))
+	// only count responses carrying the certificate
+	if recorder.status != http.StatusOK || r.Method != http.MethodGet {
+		return
+	}
+	labels := []string{"other"}
+	if downloadPaths[r.URL.Path] {
+		labels[0] = r.URL.Path
+	}
+	if s.config.MetricsClientLabel {
+		labels = append(labels, clientAddr(r))
+	}
+	s.downloads.Inc(labels...)
+
+	event := audit.Event{
+		Action: audit.ActionDownload,
+		Result: audit.ResultSuccess,
+		Client: clientAddr(r),
+		Path:   r.URL.Path,
+	}
+	if served.parsed != nil {
+		event.Fingerprint = certs.Fingerprint(served.parsed.Raw)
+		event.Names = served.parsed.DNSNames
+	}
+	audit.Record(event)
+}
+
+func (s *certServer) recordIssue(r *http.Request, result string, derBytes []byte, err error) {
+	s.issuance.Inc(result)
+
+	event := audit.Event{
+		Action: audit.ActionIssue,
+		Result: result,
+		Client: clientAddr(r),
+		Path:   r.URL.Path,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	if derBytes != nil {
+		if issued, err := x509.ParseCertificate(derBytes); err == nil {
+			event.Fingerprint = certs.Fingerprint(issued.Raw)
+			event.Serial = issued.SerialNumber.Text(16)
+			event.Names = issued.DNSNames
+			for _, ip := range issued.IPAddresses {
+				event.IPs = append(event.IPs, ip.String())
+			}
+		}
+	}
+	audit.Record(event)
+}
+
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (s *certServer) handleIssue(w http.ResponseWriter, r *http.Request) {
+	logRequest(r).Msg("certificate issuance requested")
+
+	if s.config.KeyPath == "" {
+		http.Error(w, "certificate issuance is not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		log.Warn().Str("remote", r.RemoteAddr).Msg("unauthorized issuance request")
+		s.recordIssue(r, audit.ResultUnauthorized, nil, nil)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="confiar"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBytes))
+	if err != nil {
+		http.Error(w, "unable to read request", http.StatusBadRequest)
+		return
+	}
+	csrBlock, _ := pem.Decode(body)
+	if csrBlock == nil || csrBlock.Type != "CERTIFICATE REQUEST" {
+		s.recordIssue(r, audit.ResultFailure, nil, fmt.Errorf("malformed certificate request"))
+		http.Error(w, "expected PEM encoded CERTIFICATE REQUEST", http.StatusBadRequest)
+		return
+	}
+	if err := validateRequest(csrBlock.Bytes); err != nil {
+		s.recordIssue(r, audit.ResultFailure, nil, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// sign with what is served right now, or the previous certificate while
+	// its replacement does not match the key yet
+	served, err := s.reload()
+	if err != nil {
+		log.Warn().Err(err).Msg("unable to reload certificate")
+	}
+	derBytes, err := s.issuer.SignTLSCertificateRequest(csrBlock.Bytes, served.parsed, served.caKey)
+	if err != nil {
+		log.Error().Err(err).Str("remote", r.RemoteAddr).Msg("unable to issue certificate")
+		s.recordIssue(r, audit.ResultFailure, nil, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.recordIssue(r, audit.ResultSuccess, derBytes, nil)
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	if err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
+		log.Error().Err(err).Msg("unable to write certificate")
+	}
+}
+
+func logRequest(r *http.Request) *zerolog.Event {
+	return log.Info().
+		Str("method", r.Method).
+		Stringer("url", r.URL).
+		Str("host", r.Host).
+		Str("remote", r.RemoteAddr)
+}
+
+func (s *certServer) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Token)) == 1
+}
+
+// validateRequest holds certificate requests to the same rules as generate
+func validateRequest(csrBytes []byte) error {
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		return fmt.Errorf("invalid certificate request: %w", err)
+	}
+	if len(csr.DNSNames) == 0 && len(csr.IPAddresses) == 0 {
+		return fmt.Errorf("certificate request has no domain names or IP addresses")
+	}
+	for _, name := range csr.DNSNames {
+		if !ValidFQDN(name) {
+			return fmt.Errorf("\"%v\" is not a valid fully qualified domain name (FQDN)", name)
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		if !ValidIPAddr(ip.String()) {
+			return fmt.Errorf("\"%v\" is not a valid IP address", ip)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,251 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wilsonehusin/confiar/internal/certs"
+	"github.com/wilsonehusin/confiar/internal/cryptographer"
+)
+
+// writeAuthority generates cert.pem and key.pem in dir, like confiar generate
+func writeAuthority(t *testing.T, dir string, names ...string) (certPath string, keyPath string) {
+	t.Helper()
+	if err := (&cryptographer.GoStd{}).NewTLSSelfAuthority(names, nil, dir); err != nil {
+		t.Fatal(err)
+	}
+	return path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+}
+
+func newTestServer(t *testing.T, config *ServeConfig) *httptest.Server {
+	t.Helper()
+	s, err := newCertServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux, _ := s.handlers()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func request(t *testing.T, method string, url string, header http.Header) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// metricLines returns the samples of a metric from a /metrics scrape
+func metricLines(t *testing.T, serverURL string, name string) []string {
+	t.Helper()
+	resp, err := http.Get(serverURL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{}
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, name+"{") || strings.HasPrefix(line, name+" ") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestDownloadMetrics(t *testing.T) {
+	certPath, _ := writeAuthority(t, t.TempDir(), "ca.corp")
+	server := newTestServer(t, &ServeConfig{CertPath: certPath})
+
+	first := request(t, http.MethodGet, server.URL+"/", nil)
+	if first.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", first.StatusCode)
+	}
+	request(t, http.MethodGet, server.URL+"/cert.pem", nil)
+	for i := 0; i < 20; i++ {
+		request(t, http.MethodGet, fmt.Sprintf("%s/scan/%d", server.URL, i), nil)
+	}
+	if resp := request(t, http.MethodHead, server.URL+"/", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("HEAD got status %d", resp.StatusCode)
+	}
+	revalidated := request(t, http.MethodGet, server.URL+"/", http.Header{"If-None-Match": {first.Header.Get("ETag")}})
+	if revalidated.StatusCode != http.StatusNotModified {
+		t.Errorf("revalidation got status %d", revalidated.StatusCode)
+	}
+
+	want := []string{
+		`confiar_downloads_total{path="/"} 1`,
+		`confiar_downloads_total{path="/cert.pem"} 1`,
+		`confiar_downloads_total{path="other"} 20`,
+	}
+	got := metricLines(t, server.URL, "confiar_downloads_total")
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDownloadMetricsClientLabel(t *testing.T) {
+	certPath, _ := writeAuthority(t, t.TempDir(), "ca.corp")
+	server := newTestServer(t, &ServeConfig{CertPath: certPath, MetricsClientLabel: true})
+
+	request(t, http.MethodGet, server.URL+"/", nil)
+	want := `confiar_downloads_total{path="/",client="127.0.0.1"} 1`
+	if got := metricLines(t, server.URL, "confiar_downloads_total"); len(got) != 1 || got[0] != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func copyFile(t *testing.T, src string, dst string, modTime time.Time) {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(dst, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func issueCertificate(t *testing.T, serverURL string, token string) *x509.Certificate {
+	t.Helper()
+	csrBytes, err := (&cryptographer.GoStd{}).NewTLSCertificateRequest([]string{"client.corp"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes})
+	req, err := http.NewRequest(http.MethodPost, serverURL+"/issue", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return readCertificateResponse(t, req)
+}
+
+func servedCertificate(t *testing.T, serverURL string) *x509.Certificate {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, serverURL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readCertificateResponse(t, req)
+}
+
+func readCertificateResponse(t *testing.T, req *http.Request) *x509.Certificate {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s %s got status %d: %s", req.Method, req.URL.Path, resp.StatusCode, data)
+	}
+	certData, err := certs.ParsePEM(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certData
+}
+
+func verifyIssued(t *testing.T, leaf *x509.Certificate, served *x509.Certificate) {
+	t.Helper()
+	roots := x509.NewCertPool()
+	roots.AddCert(served)
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "client.corp", Roots: roots}); err != nil {
+		t.Errorf("issued certificate does not verify against the served one: %v", err)
+	}
+}
+
+func TestIssueAfterRotation(t *testing.T) {
+	oldCert, oldKey := writeAuthority(t, t.TempDir(), "ca.corp")
+	newCert, newKey := writeAuthority(t, t.TempDir(), "ca.corp")
+
+	dir := t.TempDir()
+	certPath, keyPath := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+	copyFile(t, oldCert, certPath, start)
+	copyFile(t, oldKey, keyPath, start)
+
+	server := newTestServer(t, &ServeConfig{CertPath: certPath, KeyPath: keyPath, Token: "secret"})
+	original := servedCertificate(t, server.URL)
+	verifyIssued(t, issueCertificate(t, server.URL, "secret"), original)
+
+	// the certificate is replaced first, it is not served until the key is
+	copyFile(t, newCert, certPath, start.Add(time.Minute))
+	if resp := request(t, http.MethodGet, server.URL+"/readyz", nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("readyz got status %d with a mismatching key", resp.StatusCode)
+	}
+	served := servedCertificate(t, server.URL)
+	if !served.Equal(original) {
+		t.Error("certificate was served before its key was replaced")
+	}
+	verifyIssued(t, issueCertificate(t, server.URL, "secret"), served)
+
+	copyFile(t, newKey, keyPath, start.Add(2*time.Minute))
+	rotated := servedCertificate(t, server.URL)
+	if rotated.Equal(original) {
+		t.Fatal("rotated certificate is not served")
+	}
+	verifyIssued(t, issueCertificate(t, server.URL, "secret"), rotated)
+	if resp := request(t, http.MethodGet, server.URL+"/readyz", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("readyz got status %d after rotation", resp.StatusCode)
+	}
+}
+
+func TestServeMismatchingKey(t *testing.T) {
+	certPath, _ := writeAuthority(t, t.TempDir(), "ca.corp")
+	_, keyPath := writeAuthority(t, t.TempDir(), "ca.corp")
+	if _, err := newCertServer(&ServeConfig{CertPath: certPath, KeyPath: keyPath, Token: "secret"}); err == nil {
+		t.Error("expected an error for a key not matching the certificate")
+	}
+}
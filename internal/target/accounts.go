@@ -0,0 +1,147 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// homeDir is home when given, or else the current user's home directory. In
+// another root it comes from that root's passwd, the host's may not match.
+func homeDir(root string, home string) (string, error) {
+	if home != "" {
+		return home, nil
+	}
+	if isHostRoot(root) {
+		return os.UserHomeDir()
+	}
+	entry, err := findAccount(root, "/etc/passwd", strconv.Itoa(os.Getuid()), 2)
+	if err != nil {
+		return "", err
+	}
+	if len(entry) < 6 || entry[5] == "" {
+		return "", fmt.Errorf("no home directory for uid %d in %s", os.Getuid(), rootPath(root, "/etc/passwd"))
+	}
+	return entry[5], nil
+}
+
+// xdgDir is the XDG base directory set in env, or rel below the home
+// directory. The variable only describes the host, so it is ignored for
+// another root or an explicit home.
+func xdgDir(root string, home string, env string, rel string) (string, error) {
+	if home == "" && isHostRoot(root) {
+		if dir := os.Getenv(env); dir != "" {
+			return dir, nil
+		}
+	}
+	home, err := homeDir(root, home)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(home, rel), nil
+}
+
+// lookupOwner resolves user[:group] to IDs for chown, -1 being left alone.
+// Names are looked up in root, like the files being chowned.
+func lookupOwner(root string, owner string) (int, int, error) {
+	if owner == "" {
+		return -1, -1, nil
+	}
+	userName, groupName, _ := cut(owner, ":")
+
+	uid, err := lookupID(root, "/etc/passwd", userName, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+	if err != nil {
+		return -1, -1, err
+	}
+	gid, err := lookupID(root, "/etc/group", groupName, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+	if err != nil {
+		return -1, -1, err
+	}
+	return uid, gid, nil
+}
+
+func lookupID(root string, file string, name string, hostLookup func(string) (string, error)) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	var id string
+	if isHostRoot(root) {
+		var err error
+		if id, err = hostLookup(name); err != nil {
+			return -1, err
+		}
+	} else {
+		entry, err := findAccount(root, file, name, 0)
+		if err != nil {
+			return -1, err
+		}
+		if len(entry) < 3 {
+			return -1, fmt.Errorf("malformed entry for %s in %s", name, rootPath(root, file))
+		}
+		id = entry[2]
+	}
+	return strconv.Atoi(id)
+}
+
+// findAccount returns the fields of the first line in a passwd(5) or
+// group(5) style file whose field at index equals value
+func findAccount(root string, file string, value string, index int) ([]string, error) {
+	fullpath := rootPath(root, file)
+	f, err := os.Open(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) > index && fields[index] == value {
+			return fields, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%s not found in %s", value, fullpath)
+}
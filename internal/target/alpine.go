@@ -0,0 +1,43 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+// Alpine's update-ca-certificates does not descend into directories, minimal
+// images often ship only the ca-certificates-bundle package without it
+var alpineTrust = &trustStore{
+	name:           "alpine",
+	certDir:        "/usr/local/share/ca-certificates",
+	certFile:       "confiar-%s.crt",
+	updateCommand:  []string{"update-ca-certificates"},
+	bundle:         "/etc/ssl/certs/ca-certificates.crt",
+	appendFallback: true,
+}
+
+// Alpine also covers other musl-based images following Alpine's layout.
+type Alpine struct {
+	CertPath string
+	Root     string
+	Runner   Runner
+}
+
+func (a *Alpine) Install() error {
+	return alpineTrust.install(a.CertPath, a.Root, a.Runner)
+}
+
+func (a *Alpine) Uninstall() error {
+	return alpineTrust.uninstall(a.CertPath, a.Root, a.Runner)
+}
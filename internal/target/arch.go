@@ -0,0 +1,41 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+// same as trust anchor --store, but keeping our own file name so installing
+// again replaces the previous file
+var archTrust = &trustStore{
+	name:          "arch",
+	certDir:       "/etc/ca-certificates/trust-source/anchors",
+	certFile:      "confiar-%s.crt",
+	updateCommand: []string{"trust", "extract-compat"},
+	bundle:        "/etc/ca-certificates/extracted/tls-ca-bundle.pem",
+}
+
+type Arch struct {
+	CertPath string
+	Root     string
+	Runner   Runner
+}
+
+func (a *Arch) Install() error {
+	return archTrust.install(a.CertPath, a.Root, a.Runner)
+}
+
+func (a *Arch) Uninstall() error {
+	return archTrust.uninstall(a.CertPath, a.Root, a.Runner)
+}
@@ -0,0 +1,168 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/BurntSushi/toml"
+	"github.com/rs/zerolog/log"
+)
+
+const buildkitConfig = "/etc/buildkit/buildkitd.toml"
+
+// BuildKit adds registry entries to buildkitd.toml, which docker buildx
+// copies into builder containers together with the certificates it refers to
+type BuildKit struct {
+	CertPath   string
+	ExtraHosts []string
+	Root       string
+
+	// ConfigPath defaults to buildkitConfig, or the per-user configuration
+	// below Home when Rootless
+	ConfigPath string
+	Rootless   bool
+	Home       string
+
+	// DryRun prints the changes to buildkitd.toml instead of making them
+	DryRun bool
+}
+
+func (b *BuildKit) Install() error {
+	certBytes, certData, err := readCertificate(b.CertPath)
+	if err != nil {
+		return err
+	}
+
+	configPath, err := b.configPath()
+	if err != nil {
+		return err
+	}
+	caFile := path.Join(path.Dir(configPath), "certs", certName(certData)+".crt")
+	fullpath := rootPath(b.Root, configPath)
+
+	before, err := os.ReadFile(fullpath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	after, err := mergeBuildkitTOML(before, certHosts(certData, b.ExtraHosts), caFile)
+	if err != nil {
+		return fmt.Errorf("unable to update %s: %w", fullpath, err)
+	}
+	changed := !bytes.Equal(before, after)
+
+	if b.DryRun {
+		if changed {
+			fmt.Print(unifiedDiff(fullpath, before, after))
+		}
+		log.Info().Str("file", fullpath).Bool("changed", changed).Msg("dry run, nothing written")
+		return nil
+	}
+
+	dstpath := rootPath(b.Root, caFile)
+	log.Debug().Str("path", path.Dir(dstpath)).Msg("creating directory")
+	if err := os.MkdirAll(path.Dir(dstpath), 0755); err != nil {
+		return err
+	}
+	log.Debug().Str("file", dstpath).Msg("writing certificate")
+	if err := os.WriteFile(dstpath, certBytes, 0644); err != nil {
+		return err
+	}
+
+	if changed {
+		log.Debug().Str("file", fullpath).Msg("writing buildkitd.toml")
+		if err := replaceFile(fullpath, after); err != nil {
+			return err
+		}
+		log.Info().Str("config", configPath).Msg("recreate builders with this configuration for the changes to take effect")
+	} else {
+		log.Debug().Str("file", fullpath).Msg("buildkitd.toml unchanged")
+	}
+
+	log.Info().Str("file", dstpath).Str("config", fullpath).Msg("certificate installed")
+	return nil
+}
+
+func (b *BuildKit) configPath() (string, error) {
+	if b.ConfigPath != "" {
+		return b.ConfigPath, nil
+	}
+	if !b.Rootless {
+		return buildkitConfig, nil
+	}
+	configHome, err := xdgDir(b.Root, b.Home, "XDG_CONFIG_HOME", ".config")
+	if err != nil {
+		return "", err
+	}
+	return path.Join(configHome, "buildkit/buildkitd.toml"), nil
+}
+
+// mergeBuildkitTOML adds caFile to registry.<host>.ca for every host, keeping
+// the rest of the configuration and its comments. The configuration is
+// returned as it was when nothing needs to change.
+func mergeBuildkitTOML(data []byte, hosts []string, caFile string) ([]byte, error) {
+	config := map[string]interface{}{}
+	if err := toml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	registries, ok := config["registry"].(map[string]interface{})
+	if !ok {
+		if _, exists := config["registry"]; exists {
+			return nil, fmt.Errorf("expected a table at registry")
+		}
+		registries = map[string]interface{}{}
+	}
+
+	doc := &tomlDocument{src: string(data)}
+	changed := false
+	for _, host := range hosts {
+		registry, ok := registries[host].(map[string]interface{})
+		if !ok {
+			if _, exists := registries[host]; exists {
+				return nil, fmt.Errorf("expected a table at registry.%q", host)
+			}
+			registry = map[string]interface{}{}
+		}
+		tablePath := []string{"registry", host}
+		// unlike containerd, buildkit only accepts a list
+		if _, ok := registry["ca"]; !ok {
+			if err := doc.set(tablePath, -1, "ca", tomlStrings([]string{caFile})); err != nil {
+				return nil, err
+			}
+			changed = true
+			continue
+		}
+		added, err := mergeCA(doc, tablePath, registry, caFile)
+		if err != nil {
+			return nil, err
+		}
+		changed = changed || added
+	}
+	if !changed {
+		return data, nil
+	}
+	if err := doc.check(); err != nil {
+		return nil, err
+	}
+	return doc.Bytes(), nil
+}
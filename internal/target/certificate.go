@@ -0,0 +1,83 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/wilsonehusin/confiar/internal/certs"
+)
+
+func readCertificate(certPath string) ([]byte, *x509.Certificate, error) {
+	certBytes, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	certData, err := certs.ParsePEM(certBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certBytes, certData, nil
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// certName is a file name friendly identifier for the certificate, its first
+// subject alternative name or else its fingerprint
+func certName(certData *x509.Certificate) string {
+	switch {
+	case len(certData.DNSNames) > 0:
+		return unsafeFileChars.ReplaceAllString(certData.DNSNames[0], "_")
+	case len(certData.IPAddresses) > 0:
+		return unsafeFileChars.ReplaceAllString(certData.IPAddresses[0].String(), "_")
+	default:
+		return "confiar-" + certs.Fingerprint(certData.Raw)[:16]
+	}
+}
+
+// bundleContains reports whether the PEM bundle at bundlePath has certData
+func bundleContains(bundlePath string, certData *x509.Certificate) (bool, error) {
+	bundle, err := os.ReadFile(bundlePath)
+	if err != nil {
+		return false, fmt.Errorf("unable to read bundle: %w", err)
+	}
+	return certs.BundleContains(bundle, certData.Raw), nil
+}
+
+// certHosts lists the hostnames a registry-like target keys the certificate
+// by: its DNS names, extraHosts and its IP addresses, without duplicates
+func certHosts(certData *x509.Certificate, extraHosts []string) []string {
+	candidates := append([]string{}, certData.DNSNames...)
+	candidates = append(candidates, extraHosts...)
+	for _, ipAddr := range certData.IPAddresses {
+		candidates = append(candidates, ipAddr.String())
+	}
+
+	seen := map[string]bool{}
+	hosts := []string{}
+	for _, host := range candidates {
+		if host == "" || seen[host] {
+			continue
+		}
+		seen[host] = true
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
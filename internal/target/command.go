@@ -0,0 +1,153 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Runner executes the commands some targets need to refresh a trust store,
+// it can be replaced to exercise targets without touching the host.
+type Runner interface {
+	Run(name string, args ...string) error
+	LookPath(name string) (string, error)
+}
+
+// ErrCommandSkipped is returned by ExecRunner instead of running commands
+// when SkipCommands is set
+var ErrCommandSkipped = errors.New("command skipped")
+
+// ExecRunner runs commands on the host, or inside Root through chroot when
+// Root is not the host's root.
+type ExecRunner struct {
+	Root string
+
+	// SkipCommands only looks commands up, for roots which cannot be
+	// chrooted into, such as images of another architecture
+	SkipCommands bool
+}
+
+func runnerOrDefault(runner Runner, root string) Runner {
+	if runner != nil {
+		return runner
+	}
+	return &ExecRunner{Root: root}
+}
+
+func (e *ExecRunner) chrooted() bool {
+	return !isHostRoot(e.Root)
+}
+
+// isHostRoot reports whether root is the host's root directory
+func isHostRoot(root string) bool {
+	return root == "" || filepath.Clean(root) == "/"
+}
+
+func (e *ExecRunner) Run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	if e.chrooted() {
+		cmd = exec.Command("chroot", append([]string{e.Root, name}, args...)...)
+	}
+	if e.SkipCommands {
+		log.Warn().Strs("args", cmd.Args).Msg("skipping command, it needs to run before the root is used")
+		return fmt.Errorf("%s: %w", name, ErrCommandSkipped)
+	}
+	log.Debug().Strs("args", cmd.Args).Msg("running command")
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	log.Debug().Str("command", name).Str("output", string(output)).Msg("command finished")
+	return nil
+}
+
+// commonPath is searched for commands inside a chroot, where the host's PATH
+// means nothing
+var commonPath = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+func (e *ExecRunner) LookPath(name string) (string, error) {
+	if !e.chrooted() {
+		return exec.LookPath(name)
+	}
+	for _, dir := range commonPath {
+		candidate := filepath.Join(dir, name)
+		if info, err := os.Stat(rootPath(e.Root, candidate)); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%s: %w", name, exec.ErrNotFound)
+}
+
+// rootPath resolves an absolute path inside root
+func rootPath(root string, p string) string {
+	if root == "" {
+		return p
+	}
+	return filepath.Join(root, p)
+}
+
+// stripRoot is the inverse of rootPath
+func stripRoot(root string, p string) string {
+	if root == "" {
+		return p
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return p
+	}
+	return filepath.Join("/", rel)
+}
+
+// resolveInRoot follows symbolic links in p the way they would be followed
+// with root as /, so that absolute links do not escape to the host
+func resolveInRoot(root string, p string) (string, error) {
+	resolved := "/"
+	remaining := strings.Split(strings.TrimPrefix(filepath.Clean(p), "/"), "/")
+	for hops := 0; len(remaining) > 0; {
+		resolved = filepath.Join(resolved, remaining[0])
+		remaining = remaining[1:]
+
+		info, err := os.Lstat(rootPath(root, resolved))
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if hops++; hops > 40 {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", p)
+		}
+		link, err := os.Readlink(rootPath(root, resolved))
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(resolved), link)
+		}
+		remaining = append(strings.Split(strings.TrimPrefix(filepath.Clean(link), "/"), "/"), remaining...)
+		resolved = "/"
+	}
+	return resolved, nil
+}
@@ -0,0 +1,170 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/BurntSushi/toml"
+	"github.com/rs/zerolog/log"
+)
+
+const containerdCertDir = "/etc/containerd/certs.d"
+const containerdCertFile = "ca.crt"
+const containerdHostsFile = "hosts.toml"
+
+// Containerd configures registry hosts the way containerd's CRI plugin reads
+// them when config_path points to containerdCertDir. Unlike Docker, containerd
+// ignores certificates next to an existing hosts.toml unless it refers to them.
+type Containerd struct {
+	CertPath   string
+	ExtraHosts []string
+	Root       string
+	certBytes  []byte
+}
+
+func (c *Containerd) Install() error {
+	certBytes, certData, err := readCertificate(c.CertPath)
+	if err != nil {
+		return err
+	}
+	c.certBytes = certBytes
+
+	for _, hostname := range certHosts(certData, c.ExtraHosts) {
+		if err := c.installHost(hostname); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Containerd) installHost(hostname string) error {
+	hostDir := path.Join(containerdCertDir, hostname)
+	fullpath := rootPath(c.Root, hostDir)
+	log.Debug().Str("path", fullpath).Msg("creating directory")
+	if err := os.MkdirAll(fullpath, 0755); err != nil {
+		return err
+	}
+
+	dstpath := path.Join(fullpath, containerdCertFile)
+	log.Debug().Str("file", dstpath).Msg("writing certificate")
+	if err := os.WriteFile(dstpath, c.certBytes, 0644); err != nil {
+		return err
+	}
+
+	// hosts.toml is read by containerd itself, so it refers to the certificate
+	// without the root prefix
+	hostsPath := path.Join(fullpath, containerdHostsFile)
+	if err := mergeHostsTOML(hostsPath, hostname, path.Join(hostDir, containerdCertFile)); err != nil {
+		return fmt.Errorf("unable to update %s: %w", hostsPath, err)
+	}
+
+	log.Info().Str("file", dstpath).Str("hostname", hostname).Msg("certificate installed")
+	return nil
+}
+
+// mergeHostsTOML makes hostsPath trust caPath for hostname, keeping whatever
+// else is configured along with its comments. The file is left untouched when
+// it already does.
+func mergeHostsTOML(hostsPath string, hostname string, caPath string) error {
+	config := map[string]interface{}{}
+	existing, err := os.ReadFile(hostsPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := toml.Unmarshal(existing, &config); err != nil {
+		return err
+	}
+
+	doc := &tomlDocument{src: string(existing)}
+	changed := false
+	if _, ok := config["server"]; !ok {
+		if err := doc.set(nil, -1, "server", tomlString("https://"+hostname)); err != nil {
+			return err
+		}
+		changed = true
+	}
+	added, err := mergeCA(doc, nil, config, caPath)
+	if err != nil {
+		return err
+	}
+	changed = changed || added
+	// mirrors are configured per host, only the one serving hostname itself
+	// is presented with this certificate
+	if hosts, ok := config["host"].(map[string]interface{}); ok {
+		for endpoint, hostConfig := range hosts {
+			hostConfig, ok := hostConfig.(map[string]interface{})
+			if !ok || endpointHost(endpoint) != hostname {
+				continue
+			}
+			added, err := mergeCA(doc, []string{"host", endpoint}, hostConfig, caPath)
+			if err != nil {
+				return err
+			}
+			changed = changed || added
+		}
+	}
+
+	if !changed {
+		log.Debug().Str("file", hostsPath).Msg("hosts.toml unchanged")
+		return nil
+	}
+	if err := doc.check(); err != nil {
+		return err
+	}
+	log.Debug().Str("file", hostsPath).Msg("writing hosts.toml")
+	return replaceFile(hostsPath, doc.Bytes())
+}
+
+// mergeCA adds caPath to the ca setting of the hosts.toml table at tablePath,
+// decoded as table, which may be a single path or a list of them, and reports
+// whether anything was changed
+func mergeCA(doc *tomlDocument, tablePath []string, table map[string]interface{}, caPath string) (bool, error) {
+	switch ca := table["ca"].(type) {
+	case nil:
+		return true, doc.set(tablePath, -1, "ca", tomlString(caPath))
+	case string:
+		if ca == caPath {
+			return false, nil
+		}
+		return true, doc.set(tablePath, -1, "ca", tomlStrings([]string{ca, caPath}))
+	case []interface{}:
+		for _, existing := range ca {
+			if existing == caPath {
+				return false, nil
+			}
+		}
+		return true, doc.appendTo(tablePath, -1, "ca", tomlString(caPath))
+	default:
+		log.Warn().Interface("ca", ca).Msg("unexpected ca setting, replacing it")
+		return true, doc.set(tablePath, -1, "ca", tomlString(caPath))
+	}
+}
+
+func endpointHost(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return endpoint
+	}
+	return u.Host
+}
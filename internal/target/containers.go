@@ -0,0 +1,101 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"net"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// containersCertDir is shared by Podman, CRI-O, Buildah and skopeo
+const containersCertDir = "/etc/containers/certs.d"
+const containersCertFile = "ca.crt"
+
+type Containers struct {
+	CertPath   string
+	ExtraHosts []string
+	Root       string
+
+	// Ports are appended to every hostname, registries not listening on 443
+	// are looked up as host:port
+	Ports []int
+
+	// Rootless installs for the current user only, in
+	// $XDG_CONFIG_HOME/containers/certs.d below Home
+	Rootless bool
+	Home     string
+
+	certBytes []byte
+}
+
+func (c *Containers) Install() error {
+	certBytes, certData, err := readCertificate(c.CertPath)
+	if err != nil {
+		return err
+	}
+	c.certBytes = certBytes
+
+	certDir, err := c.certDir()
+	if err != nil {
+		return err
+	}
+	for _, hostname := range certHosts(certData, c.ExtraHosts) {
+		if err := c.installHost(certDir, hostname); err != nil {
+			return err
+		}
+		for _, port := range c.Ports {
+			// JoinHostPort brackets IPv6 addresses like registry references do
+			if err := c.installHost(certDir, net.JoinHostPort(hostname, strconv.Itoa(port))); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Containers) certDir() (string, error) {
+	if !c.Rootless {
+		return containersCertDir, nil
+	}
+	configHome, err := xdgDir(c.Root, c.Home, "XDG_CONFIG_HOME", ".config")
+	if err != nil {
+		return "", err
+	}
+	return path.Join(configHome, "containers/certs.d"), nil
+}
+
+func (c *Containers) installHost(certDir string, hostname string) error {
+	fullpath := rootPath(c.Root, path.Join(certDir, hostname))
+	log.Debug().Str("path", fullpath).Msg("creating directory")
+	if err := os.MkdirAll(fullpath, 0755); err != nil {
+		return err
+	}
+
+	dstpath := path.Join(fullpath, containersCertFile)
+	log.Debug().Str("file", dstpath).Msg("writing certificate")
+	if err := os.WriteFile(dstpath, c.certBytes, 0644); err != nil {
+		return err
+	}
+
+	log.Info().Str("file", dstpath).Str("hostname", hostname).Msg("certificate installed")
+	return nil
+}
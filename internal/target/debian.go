@@ -0,0 +1,41 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+// update-ca-certificates only picks up files ending with .crt
+var debianTrust = &trustStore{
+	name:          "debian",
+	certDir:       "/usr/local/share/ca-certificates/confiar",
+	certFile:      "%s.crt",
+	updateCommand: []string{"update-ca-certificates"},
+	bundle:        "/etc/ssl/certs/ca-certificates.crt",
+	removeCommand: []string{"update-ca-certificates", "--fresh"},
+}
+
+type Debian struct {
+	CertPath string
+	Root     string
+	Runner   Runner
+}
+
+func (d *Debian) Install() error {
+	return debianTrust.install(d.CertPath, d.Root, d.Runner)
+}
+
+func (d *Debian) Uninstall() error {
+	return debianTrust.uninstall(d.CertPath, d.Root, d.Runner)
+}
@@ -18,8 +18,6 @@ package target
 
 import (
 	"crypto/x509"
-	"encoding/pem"
-	"fmt"
 	"os"
 	"path"
 
@@ -32,34 +30,19 @@ const dockerCertFile = "ca.crt"
 type Docker struct {
 	CertPath   string
 	ExtraHosts []string
+	Root       string
 	certBytes  []byte
 }
 
 func (d *Docker) Install() error {
-	certBytes, err := os.ReadFile(d.CertPath)
+	certBytes, certData, err := readCertificate(d.CertPath)
 	if err != nil {
 		return err
 	}
 	d.certBytes = certBytes
 
-	pemBlock, _ := pem.Decode(d.certBytes)
-	if pemBlock == nil {
-		return fmt.Errorf("failed to parse certificate PEM")
-	}
-
-	certData, err := x509.ParseCertificate(pemBlock.Bytes)
-	if err != nil {
-		return err
-	}
-
-	names := append(certData.DNSNames, d.ExtraHosts...)
-	for _, name := range names {
-		if err := d.installHost(name); err != nil {
-			return err
-		}
-	}
-	for _, ipAddr := range certData.IPAddresses {
-		if err := d.installHost(ipAddr.String()); err != nil {
+	for _, hostname := range certHosts(certData, d.ExtraHosts) {
+		if err := d.installHost(hostname); err != nil {
 			return err
 		}
 	}
@@ -67,8 +50,18 @@ func (d *Docker) Install() error {
 	return nil
 }
 
+// DockerCertPaths lists the files Docker would install the certificate to,
+// for provisioning them by other means than the target
+func DockerCertPaths(certData *x509.Certificate, extraHosts []string) []string {
+	paths := []string{}
+	for _, hostname := range certHosts(certData, extraHosts) {
+		paths = append(paths, path.Join(dockerCertDir, hostname, dockerCertFile))
+	}
+	return paths
+}
+
 func (d *Docker) installHost(hostname string) error {
-	fullpath := path.Join(dockerCertDir, hostname)
+	fullpath := rootPath(d.Root, path.Join(dockerCertDir, hostname))
 	log.Debug().Str("path", fullpath).Msg("creating directory")
 	if err := os.MkdirAll(fullpath, 0755); err != nil {
 		return err
@@ -0,0 +1,158 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"text/template"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/wilsonehusin/confiar/internal/certs"
+)
+
+// File writes the certificate wherever PathTemplate says, once per hostname
+// when the template refers to {{.Host}}
+type File struct {
+	CertPath     string
+	ExtraHosts   []string
+	Root         string
+	PathTemplate string
+
+	// Owner is user or user:group, names or IDs, left alone when empty
+	Owner string
+	Mode  os.FileMode
+}
+
+// filePathData is what the path template is rendered with
+type filePathData struct {
+	Host        string
+	Name        string
+	Fingerprint string
+}
+
+func (f *File) Install() error {
+	certBytes, certData, err := readCertificate(f.CertPath)
+	if err != nil {
+		return err
+	}
+	paths, err := f.paths(certData)
+	if err != nil {
+		return err
+	}
+	uid, gid, err := lookupOwner(f.Root, f.Owner)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		fullpath := rootPath(f.Root, p.path)
+		log.Debug().Str("path", path.Dir(fullpath)).Msg("creating directory")
+		if err := os.MkdirAll(path.Dir(fullpath), 0755); err != nil {
+			return err
+		}
+		log.Debug().Str("file", fullpath).Msg("writing certificate")
+		if err := os.WriteFile(fullpath, certBytes, f.Mode); err != nil {
+			return err
+		}
+		// WriteFile leaves the mode of existing files and is subject to umask
+		if err := os.Chmod(fullpath, f.Mode); err != nil {
+			return err
+		}
+		if uid >= 0 || gid >= 0 {
+			if err := os.Chown(fullpath, uid, gid); err != nil {
+				return err
+			}
+		}
+		log.Info().Str("file", fullpath).Str("hostname", p.host).Str("mode", fmt.Sprintf("%04o", f.Mode)).Str("owner", f.Owner).Msg("certificate installed")
+	}
+	return nil
+}
+
+func (f *File) Uninstall() error {
+	_, certData, err := readCertificate(f.CertPath)
+	if err != nil {
+		return err
+	}
+	paths, err := f.paths(certData)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		fullpath := rootPath(f.Root, p.path)
+		if err := os.Remove(fullpath); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				log.Debug().Str("file", fullpath).Msg("certificate not installed")
+				continue
+			}
+			return err
+		}
+		log.Info().Str("file", fullpath).Msg("certificate uninstalled")
+	}
+	return nil
+}
+
+type renderedPath struct {
+	path string
+	host string
+}
+
+// paths renders PathTemplate for every hostname, templates without {{.Host}}
+// come out the same each time and are only written once
+func (f *File) paths(certData *x509.Certificate) ([]renderedPath, error) {
+	if f.PathTemplate == "" {
+		return nil, fmt.Errorf("no path given")
+	}
+	tmpl, err := template.New("path").Option("missingkey=error").Parse(f.PathTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path template: %w", err)
+	}
+
+	hosts := certHosts(certData, f.ExtraHosts)
+	if len(hosts) == 0 {
+		hosts = []string{""}
+	}
+	seen := map[string]bool{}
+	paths := []renderedPath{}
+	for _, host := range hosts {
+		var buf bytes.Buffer
+		data := filePathData{
+			Host:        unsafeFileChars.ReplaceAllString(host, "_"),
+			Name:        certName(certData),
+			Fingerprint: certs.Fingerprint(certData.Raw),
+		}
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("invalid path template: %w", err)
+		}
+		rendered := path.Clean(buf.String())
+		if !path.IsAbs(rendered) {
+			return nil, fmt.Errorf("path %s is not absolute", rendered)
+		}
+		if seen[rendered] {
+			continue
+		}
+		seen[rendered] = true
+		paths = append(paths, renderedPath{path: rendered, host: host})
+	}
+	return paths, nil
+}
@@ -0,0 +1,212 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/BurntSushi/toml"
+	"github.com/rs/zerolog/log"
+)
+
+const gitlabRunnerDir = "/etc/gitlab-runner"
+
+// GitLabRunner places the certificate where gitlab-runner looks it up for a
+// GitLab instance, certs/<hostname>.crt next to its config.toml
+type GitLabRunner struct {
+	CertPath   string
+	ExtraHosts []string
+	Root       string
+
+	// Rootless uses ~/.gitlab-runner below Home, which is where a runner not
+	// started by root keeps its configuration
+	Rootless bool
+	Home     string
+
+	// DockerVolumes also mounts the certificates into the jobs of every
+	// runner using the docker executor, through config.toml
+	DockerVolumes bool
+
+	// DryRun prints the changes to config.toml instead of making them
+	DryRun bool
+
+	certBytes []byte
+}
+
+func (g *GitLabRunner) Install() error {
+	certBytes, certData, err := readCertificate(g.CertPath)
+	if err != nil {
+		return err
+	}
+	g.certBytes = certBytes
+
+	configDir, err := g.configDir()
+	if err != nil {
+		return err
+	}
+	certDir := path.Join(configDir, "certs")
+
+	if g.DockerVolumes {
+		if err := g.addDockerVolume(path.Join(configDir, "config.toml"), certDir); err != nil {
+			return err
+		}
+	}
+	if g.DryRun {
+		return nil
+	}
+
+	for _, hostname := range certHosts(certData, g.ExtraHosts) {
+		if err := g.installHost(certDir, hostname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *GitLabRunner) configDir() (string, error) {
+	if !g.Rootless {
+		return gitlabRunnerDir, nil
+	}
+	home, err := homeDir(g.Root, g.Home)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(home, ".gitlab-runner"), nil
+}
+
+func (g *GitLabRunner) installHost(certDir string, hostname string) error {
+	fullpath := rootPath(g.Root, certDir)
+	log.Debug().Str("path", fullpath).Msg("creating directory")
+	if err := os.MkdirAll(fullpath, 0755); err != nil {
+		return err
+	}
+
+	dstpath := path.Join(fullpath, hostname+".crt")
+	log.Debug().Str("file", dstpath).Msg("writing certificate")
+	if err := os.WriteFile(dstpath, g.certBytes, 0644); err != nil {
+		return err
+	}
+
+	log.Info().Str("file", dstpath).Str("hostname", hostname).Msg("certificate installed")
+	return nil
+}
+
+func (g *GitLabRunner) addDockerVolume(configPath string, certDir string) error {
+	fullpath := rootPath(g.Root, configPath)
+	before, err := os.ReadFile(fullpath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	volume := certDir + ":" + certDir + ":ro"
+	after, err := mergeRunnerVolumes(before, volume)
+	if err != nil {
+		return fmt.Errorf("unable to update %s: %w", fullpath, err)
+	}
+	changed := !bytes.Equal(before, after)
+
+	if g.DryRun {
+		if changed {
+			fmt.Print(unifiedDiff(fullpath, before, after))
+		}
+		log.Info().Str("file", fullpath).Bool("changed", changed).Msg("dry run, nothing written")
+		return nil
+	}
+	if !changed {
+		log.Debug().Str("file", fullpath).Msg("config.toml unchanged")
+		return nil
+	}
+	log.Debug().Str("file", fullpath).Msg("writing config.toml")
+	if err := replaceFile(fullpath, after); err != nil {
+		return err
+	}
+	log.Info().Str("file", fullpath).Str("volume", volume).Msg("certificates mounted into docker executor jobs")
+	return nil
+}
+
+// mergeRunnerVolumes adds volume to runners.docker.volumes of every runner
+// using the docker executor, keeping the rest of the configuration and its
+// comments
+func mergeRunnerVolumes(data []byte, volume string) ([]byte, error) {
+	config := map[string]interface{}{}
+	if err := toml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	// [[runners]] tables decode as []map[string]interface{}, an inline array
+	// would not and cannot be edited in place anyway
+	runners, ok := config["runners"].([]map[string]interface{})
+	if _, exists := config["runners"]; exists && !ok {
+		return nil, fmt.Errorf("expected runners to be defined as [[runners]] tables")
+	}
+
+	doc := &tomlDocument{src: string(data)}
+	elements, err := doc.arrayTables([]string{"runners"})
+	if err != nil {
+		return nil, err
+	}
+	if len(elements) != len(runners) {
+		return nil, fmt.Errorf("expected runners to be defined as [[runners]] tables")
+	}
+
+	changed := false
+	dockerRunners := 0
+	// edits only add to the document, so the sections of earlier runners
+	// keep their place while later ones move
+	for i := len(runners) - 1; i >= 0; i-- {
+		runner := runners[i]
+		if runner["executor"] != "docker" {
+			continue
+		}
+		dockerRunners++
+		docker, _ := runner["docker"].(map[string]interface{})
+		volumes, ok := docker["volumes"].([]interface{})
+		if !ok {
+			if err := doc.set([]string{"runners", "docker"}, elements[i], "volumes", tomlStrings([]string{volume})); err != nil {
+				return nil, err
+			}
+			changed = true
+			continue
+		}
+		found := false
+		for _, existing := range volumes {
+			if existing == volume {
+				found = true
+				break
+			}
+		}
+		if !found {
+			if err := doc.appendTo([]string{"runners", "docker"}, elements[i], "volumes", tomlString(volume)); err != nil {
+				return nil, err
+			}
+			changed = true
+		}
+	}
+	if dockerRunners == 0 {
+		log.Warn().Msg("no runner uses the docker executor, register one before mounting certificates")
+	}
+	if !changed {
+		return data, nil
+	}
+	if err := doc.check(); err != nil {
+		return nil, err
+	}
+	return doc.Bytes(), nil
+}
@@ -0,0 +1,172 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+// runnerConfig is laid out the way gitlab-runner register writes config.toml
+const runnerConfig = `concurrent = 4
+check_interval = 0
+
+[session_server]
+  session_timeout = 1800
+
+# builds images
+[[runners]]
+  name = "docker-builder"
+  url = "https://gitlab.corp"
+  token = "glrt-aaaa"
+  executor = "docker"
+  [runners.cache]
+    MaxUploadedArchiveSize = 0
+  [runners.docker]
+    tls_verify = false
+    image = "alpine:3.19"
+    privileged = true
+    volumes = ["/cache", "/var/run/docker.sock:/var/run/docker.sock"] # docker in docker
+
+[[runners]]
+  name = "shell"
+  url = "https://gitlab.corp"
+  token = "glrt-bbbb"
+  executor = "shell"
+
+[[runners]]
+  name = "docker-tests"
+  url = "https://gitlab.corp"
+  token = "glrt-cccc"
+  executor = "docker"
+  [runners.cache]
+    MaxUploadedArchiveSize = 0
+
+[[runners]]
+  name = "docker-deploy"
+  url = "https://gitlab.corp"
+  token = "glrt-dddd"
+  executor = "docker"
+  [runners.docker]
+    image = "alpine:3.19"
+`
+
+func TestRunnerConfigDecoding(t *testing.T) {
+	config := map[string]interface{}{}
+	if err := toml.Unmarshal([]byte(runnerConfig), &config); err != nil {
+		t.Fatal(err)
+	}
+	runners, ok := config["runners"].([]map[string]interface{})
+	if !ok {
+		t.Fatalf("runners decoded as %T", config["runners"])
+	}
+	if len(runners) != 4 {
+		t.Fatalf("got %d runners, want 4", len(runners))
+	}
+	if _, ok := runners[0]["docker"].(map[string]interface{}); !ok {
+		t.Errorf("runners.docker decoded as %T", runners[0]["docker"])
+	}
+}
+
+func TestMergeRunnerVolumes(t *testing.T) {
+	volume := "/etc/gitlab-runner/certs:/etc/gitlab-runner/certs:ro"
+	after, err := mergeRunnerVolumes([]byte(runnerConfig), volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `concurrent = 4
+check_interval = 0
+
+[session_server]
+  session_timeout = 1800
+
+# builds images
+[[runners]]
+  name = "docker-builder"
+  url = "https://gitlab.corp"
+  token = "glrt-aaaa"
+  executor = "docker"
+  [runners.cache]
+    MaxUploadedArchiveSize = 0
+  [runners.docker]
+    tls_verify = false
+    image = "alpine:3.19"
+    privileged = true
+    volumes = ["/cache", "/var/run/docker.sock:/var/run/docker.sock", "/etc/gitlab-runner/certs:/etc/gitlab-runner/certs:ro"] # docker in docker
+
+[[runners]]
+  name = "shell"
+  url = "https://gitlab.corp"
+  token = "glrt-bbbb"
+  executor = "shell"
+
+[[runners]]
+  name = "docker-tests"
+  url = "https://gitlab.corp"
+  token = "glrt-cccc"
+  executor = "docker"
+  [runners.cache]
+    MaxUploadedArchiveSize = 0
+
+  [runners.docker]
+    volumes = ["/etc/gitlab-runner/certs:/etc/gitlab-runner/certs:ro"]
+
+[[runners]]
+  name = "docker-deploy"
+  url = "https://gitlab.corp"
+  token = "glrt-dddd"
+  executor = "docker"
+  [runners.docker]
+    image = "alpine:3.19"
+    volumes = ["/etc/gitlab-runner/certs:/etc/gitlab-runner/certs:ro"]
+`
+	if string(after) != want {
+		t.Errorf("got\n%s\nwant\n%s", after, want)
+	}
+
+	config := map[string]interface{}{}
+	if err := toml.Unmarshal(after, &config); err != nil {
+		t.Fatal(err)
+	}
+	for _, runner := range config["runners"].([]map[string]interface{}) {
+		docker, _ := runner["docker"].(map[string]interface{})
+		volumes, _ := docker["volumes"].([]interface{})
+		found := false
+		for _, existing := range volumes {
+			found = found || existing == volume
+		}
+		if found != (runner["executor"] == "docker") {
+			t.Errorf("runner %s has volumes %v", runner["name"], volumes)
+		}
+	}
+
+	unchanged, err := mergeRunnerVolumes(after, volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(unchanged) != want {
+		t.Errorf("second run changed config.toml\n%s", unchanged)
+	}
+}
+
+func TestMergeRunnerVolumesInline(t *testing.T) {
+	config := `runners = [{ name = "inline", executor = "docker" }]` + "\n"
+	if _, err := mergeRunnerVolumes([]byte(config), "/certs:/certs:ro"); err == nil {
+		t.Error("expected an error for runners which are not [[runners]] tables")
+	}
+}
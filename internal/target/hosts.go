@@ -0,0 +1,118 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const hostsFile = "/etc/hosts"
+
+// Hosts resolves the certificate's DNS names in /etc/hosts, for networks
+// without DNS for them. Every certificate gets its own managed block.
+type Hosts struct {
+	CertPath   string
+	ExtraNames []string
+	Root       string
+
+	// Address the names resolve to, the certificate's IP addresses when empty
+	Address string
+}
+
+func (h *Hosts) Install() error {
+	_, certData, err := readCertificate(h.CertPath)
+	if err != nil {
+		return err
+	}
+	block, err := h.block(certData)
+	if err != nil {
+		return err
+	}
+
+	fullpath := rootPath(h.Root, hostsFile)
+	changed, err := setManagedBlock(fullpath, certName(certData), block)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		log.Info().Str("file", fullpath).Msg("hosts already up to date")
+		return nil
+	}
+	log.Info().Str("file", fullpath).Str("entries", strings.TrimSpace(block)).Msg("hosts updated")
+	return nil
+}
+
+func (h *Hosts) Uninstall() error {
+	_, certData, err := readCertificate(h.CertPath)
+	if err != nil {
+		return err
+	}
+
+	fullpath := rootPath(h.Root, hostsFile)
+	changed, err := setManagedBlock(fullpath, certName(certData), "")
+	if err != nil {
+		return err
+	}
+	if !changed {
+		log.Info().Str("file", fullpath).Msg("hosts had no entries for this certificate")
+		return nil
+	}
+	log.Info().Str("file", fullpath).Msg("hosts entries removed")
+	return nil
+}
+
+// block has one line per address, each listing every name
+func (h *Hosts) block(certData *x509.Certificate) (string, error) {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, name := range append(append([]string{}, certData.DNSNames...), h.ExtraNames...) {
+		if strings.HasPrefix(name, "*.") {
+			log.Warn().Str("name", name).Msg("wildcards cannot be resolved through hosts, skipping")
+			continue
+		}
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("certificate has no names to resolve")
+	}
+
+	addresses := []string{}
+	if h.Address != "" {
+		addresses = append(addresses, h.Address)
+	} else {
+		for _, ipAddr := range certData.IPAddresses {
+			addresses = append(addresses, ipAddr.String())
+		}
+	}
+	if len(addresses) == 0 {
+		return "", fmt.Errorf("certificate has no IP addresses, an address to resolve names to is needed")
+	}
+
+	var b strings.Builder
+	for _, address := range addresses {
+		fmt.Fprintf(&b, "%s\t%s\n", address, strings.Join(names, " "))
+	}
+	return b.String(), nil
+}
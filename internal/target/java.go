@@ -0,0 +1,223 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/wilsonehusin/confiar/internal/certs"
+	"github.com/wilsonehusin/confiar/internal/keystore"
+)
+
+// javaHomeGlobs are where JDKs are commonly installed, on top of JAVA_HOME
+var javaHomeGlobs = []string{
+	"/usr/lib/jvm/*",
+	"/usr/lib64/jvm/*",
+	"/usr/java/*",
+	"/usr/local/openjdk-*",
+	"/opt/java/*",
+	"/opt/jdk*",
+	"/Library/Java/JavaVirtualMachines/*/Contents/Home",
+}
+
+// cacerts moved out of jre/ with JDK 9
+var javaCacerts = []string{
+	"lib/security/cacerts",
+	"jre/lib/security/cacerts",
+}
+
+// managedKeystores are regenerated from the system trust store by the
+// distribution, dropping whatever was added to them directly
+var managedKeystores = map[string]struct {
+	tool    string
+	targets []string
+}{
+	"/etc/ssl/certs/java/cacerts":              {tool: "ca-certificates-java, trust extract-compat", targets: []string{"debian", "arch"}},
+	"/etc/pki/ca-trust/extracted/java/cacerts": {tool: "update-ca-trust", targets: []string{"rhel"}},
+	"/var/lib/ca-certificates/java-cacerts":    {tool: "update-ca-certificates", targets: []string{"suse"}},
+}
+
+// Java adds the certificate to the cacerts keystore of every JDK found, or
+// only the one in JavaHome when given.
+type Java struct {
+	CertPath string
+	Root     string
+	JavaHome string
+	// Password protects the integrity of the keystore, JDKs ship with
+	// keystore.DefaultPassword
+	Password string
+}
+
+func (j *Java) Install() error {
+	_, certData, err := readCertificate(j.CertPath)
+	if err != nil {
+		return err
+	}
+	alias := javaAlias(certData.Raw)
+
+	return j.eachKeystore(func(ks keystore.Keystore) (bool, error) {
+		if ks.Contains(alias) {
+			log.Debug().Str("alias", alias).Msg("certificate already in keystore")
+			return false, nil
+		}
+		return true, ks.AddTrustedCertificate(alias, certData.Raw, time.Now())
+	})
+}
+
+func (j *Java) Uninstall() error {
+	_, certData, err := readCertificate(j.CertPath)
+	if err != nil {
+		return err
+	}
+	alias := javaAlias(certData.Raw)
+
+	return j.eachKeystore(func(ks keystore.Keystore) (bool, error) {
+		return ks.Remove(alias), nil
+	})
+}
+
+func javaAlias(der []byte) string {
+	return "confiar-" + certs.Fingerprint(der)
+}
+
+// eachKeystore rewrites every keystore for which update reports a change
+func (j *Java) eachKeystore(update func(keystore.Keystore) (bool, error)) error {
+	keystores, err := j.keystores()
+	if err != nil {
+		return err
+	}
+	if len(keystores) == 0 {
+		return fmt.Errorf("no Java installations found, set JAVA_HOME or --java-home")
+	}
+
+	password := j.Password
+	if password == "" {
+		password = keystore.DefaultPassword
+	}
+	for _, ksPath := range keystores {
+		if managed, ok := managedKeystores[ksPath]; ok {
+			log.Warn().Str("keystore", ksPath).Str("tool", managed.tool).Strs("targets", managed.targets).
+				Msg("keystore is regenerated from the system trust store, install with --target system or one of targets to keep the certificate")
+		}
+		fullpath := rootPath(j.Root, ksPath)
+		data, err := os.ReadFile(fullpath)
+		if err != nil {
+			return err
+		}
+		ks, err := keystore.Parse(data, password)
+		if err != nil {
+			return fmt.Errorf("%s: %w", ksPath, err)
+		}
+
+		changed, err := update(ks)
+		if err != nil {
+			return fmt.Errorf("%s: %w", ksPath, err)
+		}
+		if !changed {
+			log.Info().Str("keystore", ksPath).Str("format", ks.Format()).Msg("keystore unchanged")
+			continue
+		}
+
+		data, err = ks.Marshal(password)
+		if err != nil {
+			return fmt.Errorf("%s: %w", ksPath, err)
+		}
+		if err := replaceFile(fullpath, data); err != nil {
+			return err
+		}
+		log.Info().Str("keystore", ksPath).Str("format", ks.Format()).Msg("keystore updated")
+	}
+	return nil
+}
+
+// keystores lists cacerts of every JDK, resolved through symlinks so that
+// distributions sharing one file between JDKs only get it updated once
+func (j *Java) keystores() ([]string, error) {
+	homes := []string{}
+	if j.JavaHome != "" {
+		homes = append(homes, j.JavaHome)
+	} else {
+		// JAVA_HOME describes the host, not another root
+		if javaHome := os.Getenv("JAVA_HOME"); javaHome != "" && isHostRoot(j.Root) {
+			homes = append(homes, javaHome)
+		}
+		for _, pattern := range javaHomeGlobs {
+			matches, err := filepath.Glob(rootPath(j.Root, pattern))
+			if err != nil {
+				return nil, err
+			}
+			for _, match := range matches {
+				homes = append(homes, stripRoot(j.Root, match))
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	keystores := []string{}
+	for _, home := range homes {
+		for _, cacerts := range javaCacerts {
+			resolved, err := resolveInRoot(j.Root, path.Join(home, cacerts))
+			if err != nil {
+				continue
+			}
+			if info, err := os.Stat(rootPath(j.Root, resolved)); err != nil || info.IsDir() {
+				continue
+			}
+			if !seen[resolved] {
+				seen[resolved] = true
+				keystores = append(keystores, resolved)
+				log.Debug().Str("javaHome", home).Str("keystore", resolved).Msg("found keystore")
+			}
+			break
+		}
+	}
+	return keystores, nil
+}
+
+// replaceFile writes data next to dst before moving it over dst, so that a
+// failure half way does not leave a corrupted file behind
+func replaceFile(dst string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(dst); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(path.Dir(dst), "."+path.Base(dst)+".confiar-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/wilsonehusin/confiar/internal/keystore"
+)
+
+// the JDK package links cacerts to the keystore update-ca-trust extracts, the
+// way RHEL and Fedora ship it
+func TestJavaManagedKeystore(t *testing.T) {
+	const managed = "/etc/pki/ca-trust/extracted/java/cacerts"
+	root := t.TempDir()
+	fixture, err := os.ReadFile("../keystore/testdata/truststore.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Dir(rootPath(root, managed)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(rootPath(root, managed), fixture, 0644); err != nil {
+		t.Fatal(err)
+	}
+	security := rootPath(root, "/usr/lib/jvm/java-17-openjdk/lib/security")
+	if err := os.MkdirAll(security, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(managed, path.Join(security, "cacerts")); err != nil {
+		t.Fatal(err)
+	}
+
+	certPath, certData := writeTestCertificate(t, t.TempDir())
+	java := &Java{CertPath: certPath, Root: root}
+	keystores, err := java.keystores()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{managed}; !reflect.DeepEqual(keystores, want) {
+		t.Fatalf("got keystores %q, want %q", keystores, want)
+	}
+	if entry, ok := managedKeystores[keystores[0]]; !ok || !reflect.DeepEqual(entry.targets, []string{"rhel"}) {
+		t.Errorf("keystore is not recognised as managed by rhel: %+v", entry)
+	}
+
+	// the keystore is still updated, only with a warning
+	if err := java.Install(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(rootPath(root, managed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := keystore.Parse(data, keystore.DefaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ks.Contains(javaAlias(certData.Raw)) {
+		t.Error("certificate was not added to the keystore")
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// K3s configures registry TLS in registries.yaml, which k3s and RKE2 read
+// from /etc/rancher/<Distribution>/ when they start
+type K3s struct {
+	CertPath     string
+	ExtraHosts   []string
+	Root         string
+	Distribution string
+
+	// DryRun prints the changes to registries.yaml instead of making them
+	DryRun bool
+}
+
+func (k *K3s) Install() error {
+	certBytes, certData, err := readCertificate(k.CertPath)
+	if err != nil {
+		return err
+	}
+
+	configDir := path.Join("/etc/rancher", k.Distribution)
+	caFile := path.Join(configDir, "confiar", certName(certData)+".crt")
+	registries := rootPath(k.Root, path.Join(configDir, "registries.yaml"))
+
+	before, err := os.ReadFile(registries)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	after, err := mergeRegistriesYAML(before, certHosts(certData, k.ExtraHosts), caFile)
+	if err != nil {
+		return fmt.Errorf("unable to update %s: %w", registries, err)
+	}
+	changed := !bytes.Equal(before, after)
+
+	if k.DryRun {
+		if changed {
+			fmt.Print(unifiedDiff(registries, before, after))
+		}
+		log.Info().Str("file", registries).Bool("changed", changed).Msg("dry run, nothing written")
+		return nil
+	}
+
+	dstpath := rootPath(k.Root, caFile)
+	log.Debug().Str("path", path.Dir(dstpath)).Msg("creating directory")
+	if err := os.MkdirAll(path.Dir(dstpath), 0755); err != nil {
+		return err
+	}
+	log.Debug().Str("file", dstpath).Msg("writing certificate")
+	if err := os.WriteFile(dstpath, certBytes, 0644); err != nil {
+		return err
+	}
+
+	if changed {
+		log.Debug().Str("file", registries).Msg("writing registries.yaml")
+		if err := replaceFile(registries, after); err != nil {
+			return err
+		}
+		log.Info().Str("distribution", k.Distribution).Msg("restart the service for registries.yaml changes to take effect")
+	} else {
+		log.Debug().Str("file", registries).Msg("registries.yaml unchanged")
+	}
+
+	log.Info().Str("file", dstpath).Str("registries", registries).Msg("certificate installed")
+	return nil
+}
+
+// mergeRegistriesYAML sets configs.<host>.tls.ca_file for every host, leaving
+// the rest of the document, comments included, as it was
+func mergeRegistriesYAML(data []byte, hosts []string, caFile string) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("expected a mapping at the top level")
+	}
+
+	changed := false
+	configs, err := mappingValue(root, "configs")
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		hostConfig, err := mappingValue(configs, host)
+		if err != nil {
+			return nil, err
+		}
+		tls, err := mappingValue(hostConfig, "tls")
+		if err != nil {
+			return nil, err
+		}
+		if setScalar(tls, "ca_file", caFile) {
+			changed = true
+		}
+	}
+	if !changed {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// mappingValue returns the mapping under key in parent, adding an empty one
+// when key is missing
+func mappingValue(parent *yaml.Node, key string) (*yaml.Node, error) {
+	for i := 0; i+1 < len(parent.Content); i += 2 {
+		if parent.Content[i].Value != key {
+			continue
+		}
+		value := parent.Content[i+1]
+		if value.Kind == yaml.ScalarNode && value.Tag == "!!null" {
+			value.Kind, value.Tag, value.Value = yaml.MappingNode, "", ""
+		}
+		if value.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("expected a mapping at %s", key)
+		}
+		return value, nil
+	}
+	value := &yaml.Node{Kind: yaml.MappingNode}
+	parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+	return value, nil
+}
+
+// setScalar sets key in parent to value and reports whether that changed it
+func setScalar(parent *yaml.Node, key string, value string) bool {
+	for i := 0; i+1 < len(parent.Content); i += 2 {
+		if parent.Content[i].Value != key {
+			continue
+		}
+		existing := parent.Content[i+1]
+		if existing.Kind == yaml.ScalarNode && existing.Value == value {
+			return false
+		}
+		if existing.Value != "" {
+			log.Warn().Str("key", key).Str("from", existing.Value).Str("to", value).Msg("replacing existing setting")
+		}
+		parent.Content[i+1] = &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+		return true
+	}
+	parent.Content = append(parent.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Value: value})
+	return true
+}
@@ -0,0 +1,163 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+)
+
+const k3sCAFile = "/etc/rancher/k3s/confiar/registry.corp.crt"
+
+// registriesConfig is laid out the way the k3s documentation suggests
+const registriesConfig = `# managed by ops
+mirrors:
+  docker.io:
+    endpoint:
+      - "https://mirror.corp" # pull-through cache
+configs:
+  registry.corp:
+    auth:
+      username: robot
+      password: hunter2
+    tls:
+      ca_file: /etc/old/ca.crt
+`
+
+func TestMergeRegistriesYAML(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "existing configuration",
+			data: registriesConfig,
+			want: `# managed by ops
+mirrors:
+  docker.io:
+    endpoint:
+      - "https://mirror.corp" # pull-through cache
+configs:
+  registry.corp:
+    auth:
+      username: robot
+      password: hunter2
+    tls:
+      ca_file: /etc/rancher/k3s/confiar/registry.corp.crt
+  10.0.0.5:
+    tls:
+      ca_file: /etc/rancher/k3s/confiar/registry.corp.crt
+`,
+		},
+		{
+			name: "empty",
+			data: "",
+			want: `configs:
+  registry.corp:
+    tls:
+      ca_file: /etc/rancher/k3s/confiar/registry.corp.crt
+  10.0.0.5:
+    tls:
+      ca_file: /etc/rancher/k3s/confiar/registry.corp.crt
+`,
+		},
+		{
+			name: "empty configs",
+			data: "mirrors: {}\nconfigs:\n",
+			want: `mirrors: {}
+configs:
+  registry.corp:
+    tls:
+      ca_file: /etc/rancher/k3s/confiar/registry.corp.crt
+  10.0.0.5:
+    tls:
+      ca_file: /etc/rancher/k3s/confiar/registry.corp.crt
+`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			hosts := []string{"registry.corp", "10.0.0.5"}
+			got, err := mergeRegistriesYAML([]byte(tc.data), hosts, k3sCAFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tc.want)
+			}
+
+			again, err := mergeRegistriesYAML(got, hosts, k3sCAFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again, got) {
+				t.Errorf("merging again changed the document to\n%s", again)
+			}
+		})
+	}
+}
+
+func TestMergeRegistriesYAMLInvalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"list":           "- registry.corp\n",
+		"configs scalar": "configs: registry.corp\n",
+		"tls scalar":     "configs:\n  registry.corp:\n    tls: true\n",
+		"malformed":      "configs: [\n",
+		"host not a map": "configs:\n  registry.corp: []\n",
+	} {
+		if _, err := mergeRegistriesYAML([]byte(data), []string{"registry.corp"}, k3sCAFile); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestK3sDryRun(t *testing.T) {
+	root := t.TempDir()
+	registries := rootPath(root, "/etc/rancher/k3s/registries.yaml")
+	if err := os.MkdirAll(path.Dir(registries), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(registries, []byte(registriesConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	certPath, _ := writeTestCertificate(t, t.TempDir())
+
+	k3s := &K3s{CertPath: certPath, Root: root, Distribution: "k3s", DryRun: true}
+	if err := k3s.Install(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(registries); err != nil || string(data) != registriesConfig {
+		t.Errorf("dry run changed registries.yaml to\n%s (%v)", data, err)
+	}
+	if _, err := os.Stat(rootPath(root, path.Dir(k3sCAFile))); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote the certificate: %v", err)
+	}
+
+	k3s.DryRun = false
+	if err := k3s.Install(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(rootPath(root, k3sCAFile)); err != nil {
+		t.Errorf("certificate was not written: %v", err)
+	}
+	if data, err := os.ReadFile(registries); err != nil || bytes.Contains(data, []byte("/etc/old/ca.crt")) {
+		t.Errorf("registries.yaml was not updated:\n%s (%v)", data, err)
+	}
+}
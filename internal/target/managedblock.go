@@ -0,0 +1,96 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const managedBlockBegin = "# BEGIN confiar managed block"
+const managedBlockEnd = "# END confiar managed block"
+
+// setManagedBlock replaces the lines confiar owns in a file shared with its
+// user, adding them at the end the first time. Blocks with different names
+// are kept apart. An empty content removes the block, and the file too when
+// nothing else is left. It reports whether the file was changed.
+func setManagedBlock(filePath string, name string, content string) (bool, error) {
+	existing, err := os.ReadFile(filePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	if content == "" && existing == nil {
+		return false, nil
+	}
+
+	begin, end := managedBlockBegin, managedBlockEnd
+	if name != "" {
+		begin += " for " + name
+		end += " for " + name
+	}
+	begin += ", changes will be overwritten"
+
+	before, after := splitManagedBlock(string(existing), begin, end)
+	updated := before
+	if content != "" {
+		if updated != "" && !strings.HasSuffix(updated, "\n") {
+			updated += "\n"
+		}
+		updated += begin + "\n" + strings.TrimSuffix(content, "\n") + "\n" + end + "\n"
+	}
+	updated += after
+
+	if updated == string(existing) {
+		log.Debug().Str("file", filePath).Msg("managed block unchanged")
+		return false, nil
+	}
+	if strings.TrimSpace(updated) == "" {
+		log.Debug().Str("file", filePath).Msg("removing file left empty")
+		return true, os.Remove(filePath)
+	}
+
+	if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+		return false, err
+	}
+	log.Debug().Str("file", filePath).Msg("writing managed block")
+	return true, replaceFile(filePath, []byte(updated))
+}
+
+// splitManagedBlock returns what comes before and after the managed block,
+// or the whole text as before when there is none
+func splitManagedBlock(text string, begin string, end string) (string, string) {
+	start := strings.Index(text, begin+"\n")
+	if start < 0 {
+		return text, ""
+	}
+	rest := text[start:]
+	stop := strings.Index(rest, end+"\n")
+	if stop < 0 && strings.HasSuffix(rest, end) {
+		stop = len(rest) - len(end)
+	}
+	if stop < 0 {
+		// a truncated block swallows the rest of the file rather than
+		// leaving a second one behind
+		return text[:start], ""
+	}
+	return text[:start], strings.TrimPrefix(rest[stop+len(end):], "\n")
+}
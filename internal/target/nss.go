@@ -0,0 +1,309 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const nssCertutil = "certutil"
+
+// trusted to issue server certificates, nothing else
+const nssTrustFlags = "C,,"
+
+// firefoxPolicies is read by Firefox regardless of packaging (including snap),
+// installing certificates through it does not need certutil
+const firefoxPolicies = "/etc/firefox/policies/policies.json"
+
+// nssDatabaseGlobs are relative to the home directory
+var nssDatabaseGlobs = []string{
+	".pki/nssdb",
+	"snap/chromium/current/.pki/nssdb",
+	".mozilla/firefox/*",
+	"snap/firefox/common/.mozilla/firefox/*",
+	".var/app/org.mozilla.firefox/.mozilla/firefox/*",
+}
+
+// NSS adds the certificate to the NSS databases used by Chromium and Firefox,
+// which ignore the system trust store on Linux.
+type NSS struct {
+	CertPath string
+	Root     string
+	// Home is searched for databases, defaults to the current user's inside
+	// Root
+	Home   string
+	Runner Runner
+}
+
+func (n *NSS) Install() error {
+	_, certData, err := readCertificate(n.CertPath)
+	if err != nil {
+		return err
+	}
+	nickname := "confiar-" + certName(certData)
+
+	databases, err := n.databases()
+	if err != nil {
+		return err
+	}
+
+	runner := runnerOrDefault(n.Runner, n.Root)
+	if _, err := runner.LookPath(nssCertutil); err != nil {
+		log.Warn().Err(err).Msg("certutil not found, falling back to Firefox enterprise policy")
+		return n.installPolicyOnly(nickname, databases)
+	}
+
+	if len(databases) == 0 {
+		return fmt.Errorf("no NSS databases found, the browser needs to be started at least once")
+	}
+	certArg, cleanup, err := n.certInRoot()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	for _, database := range databases {
+		log.Debug().Str("database", database).Str("nickname", nickname).Msg("adding certificate")
+		err := runner.Run(nssCertutil, "-d", database, "-A", "-t", nssTrustFlags, "-n", nickname, "-i", certArg)
+		if errors.Is(err, ErrCommandSkipped) {
+			log.Warn().Msg("certutil skipped, falling back to Firefox enterprise policy")
+			return n.installPolicyOnly(nickname, databases)
+		}
+		if err != nil {
+			return err
+		}
+		log.Info().Str("database", database).Str("nickname", nickname).Msg("certificate installed")
+	}
+	return nil
+}
+
+// certInRoot makes CertPath available to certutil, which only sees Root when
+// run through chroot
+func (n *NSS) certInRoot() (string, func(), error) {
+	if isHostRoot(n.Root) {
+		return n.CertPath, func() {}, nil
+	}
+	certBytes, err := os.ReadFile(n.CertPath)
+	if err != nil {
+		return "", nil, err
+	}
+	tmpDir := rootPath(n.Root, "/tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return "", nil, err
+	}
+	tmp, err := os.CreateTemp(tmpDir, "confiar-*.crt")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.Remove(tmp.Name()) }
+	if _, err := tmp.Write(certBytes); err != nil {
+		tmp.Close()
+		cleanup()
+		return "", nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return stripRoot(n.Root, tmp.Name()), cleanup, nil
+}
+
+func (n *NSS) Uninstall() error {
+	_, certData, err := readCertificate(n.CertPath)
+	if err != nil {
+		return err
+	}
+	nickname := "confiar-" + certName(certData)
+
+	databases, err := n.databases()
+	if err != nil {
+		return err
+	}
+
+	runner := runnerOrDefault(n.Runner, n.Root)
+	if _, err := runner.LookPath(nssCertutil); err != nil {
+		log.Warn().Err(err).Msg("certutil not found, only removing Firefox enterprise policy")
+		return n.uninstallPolicyOnly(nickname, databases)
+	}
+	for _, database := range databases {
+		if err := runner.Run(nssCertutil, "-d", database, "-L", "-n", nickname); errors.Is(err, ErrCommandSkipped) {
+			log.Warn().Msg("certutil skipped, only removing Firefox enterprise policy")
+			return n.uninstallPolicyOnly(nickname, databases)
+		} else if err != nil {
+			log.Debug().Str("database", database).Str("nickname", nickname).Msg("certificate not in database")
+			continue
+		}
+		if err := runner.Run(nssCertutil, "-d", database, "-D", "-n", nickname); err != nil {
+			return err
+		}
+		log.Info().Str("database", database).Str("nickname", nickname).Msg("certificate removed")
+	}
+	return n.uninstallPolicy(nickname)
+}
+
+// installPolicyOnly covers Firefox through its policy, databases of other
+// browsers can only be updated by certutil and fail the install
+func (n *NSS) installPolicyOnly(nickname string, databases []string) error {
+	if err := n.installPolicy(nickname); err != nil {
+		return err
+	}
+	log.Warn().Strs("databases", databases).Msg("the enterprise policy only applies to Firefox, NSS databases were left unchanged")
+	unconfigured := []string{}
+	for _, database := range databases {
+		if !strings.Contains(database, "firefox") {
+			unconfigured = append(unconfigured, database)
+		}
+	}
+	if len(unconfigured) > 0 {
+		return fmt.Errorf("certutil is required to add the certificate to %s", strings.Join(unconfigured, ", "))
+	}
+	return nil
+}
+
+// uninstallPolicyOnly fails when there are databases at all, as they may hold
+// the certificate from an earlier install through certutil or the policy
+func (n *NSS) uninstallPolicyOnly(nickname string, databases []string) error {
+	if err := n.uninstallPolicy(nickname); err != nil {
+		return err
+	}
+	if len(databases) > 0 {
+		return fmt.Errorf("certutil is required to remove the certificate from %s", strings.Join(databases, ", "))
+	}
+	return nil
+}
+
+// databases are returned as certutil expects them, with the sql: or dbm:
+// prefix for their format and relative to Root
+func (n *NSS) databases() ([]string, error) {
+	home, err := homeDir(n.Root, n.Home)
+	if err != nil {
+		return nil, err
+	}
+
+	databases := []string{}
+	for _, pattern := range nssDatabaseGlobs {
+		matches, err := filepath.Glob(rootPath(n.Root, path.Join(home, pattern)))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			dir := stripRoot(n.Root, match)
+			if _, err := os.Stat(path.Join(match, "cert9.db")); err == nil {
+				databases = append(databases, "sql:"+dir)
+			} else if _, err := os.Stat(path.Join(match, "cert8.db")); err == nil {
+				databases = append(databases, "dbm:"+dir)
+			}
+		}
+	}
+	log.Debug().Strs("databases", databases).Str("home", home).Msg("discovered NSS databases")
+	return databases, nil
+}
+
+func (n *NSS) installPolicy(nickname string) error {
+	certBytes, err := os.ReadFile(n.CertPath)
+	if err != nil {
+		return err
+	}
+	policyDir := rootPath(n.Root, path.Dir(firefoxPolicies))
+	if err := os.MkdirAll(policyDir, 0755); err != nil {
+		return err
+	}
+	certFile := path.Join(path.Dir(firefoxPolicies), nickname+".crt")
+	if err := os.WriteFile(rootPath(n.Root, certFile), certBytes, 0644); err != nil {
+		return err
+	}
+
+	err = n.updatePolicy(func(install []interface{}) []interface{} {
+		for _, entry := range install {
+			if entry == certFile {
+				return install
+			}
+		}
+		return append(install, certFile)
+	})
+	if err != nil {
+		return err
+	}
+	log.Info().Str("file", certFile).Str("policy", firefoxPolicies).Msg("certificate installed")
+	return nil
+}
+
+func (n *NSS) uninstallPolicy(nickname string) error {
+	policyFile := rootPath(n.Root, firefoxPolicies)
+	if _, err := os.Stat(policyFile); os.IsNotExist(err) {
+		return nil
+	}
+
+	certFile := path.Join(path.Dir(firefoxPolicies), nickname+".crt")
+	err := n.updatePolicy(func(install []interface{}) []interface{} {
+		kept := []interface{}{}
+		for _, entry := range install {
+			if entry != certFile {
+				kept = append(kept, entry)
+			}
+		}
+		return kept
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(rootPath(n.Root, certFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Info().Str("file", certFile).Str("policy", firefoxPolicies).Msg("certificate removed")
+	return nil
+}
+
+// updatePolicy rewrites policies.Certificates.Install, keeping other policies
+func (n *NSS) updatePolicy(update func([]interface{}) []interface{}) error {
+	policyFile := rootPath(n.Root, firefoxPolicies)
+	document := map[string]interface{}{}
+	if data, err := os.ReadFile(policyFile); err == nil {
+		if err := json.Unmarshal(data, &document); err != nil {
+			return fmt.Errorf("unable to parse %s: %w", policyFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	policies := jsonObject(document, "policies")
+	certificates := jsonObject(policies, "Certificates")
+	install, _ := certificates["Install"].([]interface{})
+	certificates["Install"] = update(install)
+
+	data, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(policyFile, append(data, '\n'), 0644)
+}
+
+func jsonObject(parent map[string]interface{}, key string) map[string]interface{} {
+	child, ok := parent[key].(map[string]interface{})
+	if !ok {
+		child = map[string]interface{}{}
+		parent[key] = child
+	}
+	return child
+}
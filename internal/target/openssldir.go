@@ -0,0 +1,272 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/wilsonehusin/confiar/internal/certs"
+)
+
+// OpenSSLDir adds the certificate to a directory OpenSSL looks certificates
+// up in by subject hash, as c_rehash would, for software using SSL_CERT_DIR
+// or -CApath.
+type OpenSSLDir struct {
+	CertPath string
+	Dir      string
+	Root     string
+}
+
+func (o *OpenSSLDir) Install() error {
+	certBytes, certData, err := readCertificate(o.CertPath)
+	if err != nil {
+		return err
+	}
+	if o.Dir == "" {
+		return fmt.Errorf("no certificate directory given")
+	}
+	dir := rootPath(o.Root, o.Dir)
+	log.Debug().Str("path", dir).Msg("creating directory")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	certFile := "confiar-" + certName(certData) + ".pem"
+	dstpath := path.Join(dir, certFile)
+	log.Debug().Str("file", dstpath).Msg("writing certificate")
+	if err := os.WriteFile(dstpath, certBytes, 0644); err != nil {
+		return err
+	}
+
+	hash, err := subjectHash(certData)
+	if err != nil {
+		return err
+	}
+	links, err := hashLinks(dir, hash)
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		if linkHasCertificate(path.Join(dir, link), certData) {
+			log.Info().Str("file", dstpath).Str("link", link).Msg("certificate already installed")
+			return nil
+		}
+	}
+
+	// hash collisions between different subjects get the next free suffix
+	link := fmt.Sprintf("%08x.%d", hash, len(links))
+	log.Debug().Str("link", link).Str("target", certFile).Msg("creating symbolic link")
+	if err := os.Symlink(certFile, path.Join(dir, link)); err != nil {
+		return err
+	}
+
+	log.Info().Str("file", dstpath).Str("link", link).Msg("certificate installed")
+	return nil
+}
+
+func (o *OpenSSLDir) Uninstall() error {
+	_, certData, err := readCertificate(o.CertPath)
+	if err != nil {
+		return err
+	}
+	if o.Dir == "" {
+		return fmt.Errorf("no certificate directory given")
+	}
+	dir := rootPath(o.Root, o.Dir)
+
+	hash, err := subjectHash(certData)
+	if err != nil {
+		return err
+	}
+	links, err := hashLinks(dir, hash)
+	if err != nil {
+		return err
+	}
+	kept := []string{}
+	for _, link := range links {
+		fullpath := path.Join(dir, link)
+		if !linkHasCertificate(fullpath, certData) {
+			kept = append(kept, link)
+			continue
+		}
+		log.Debug().Str("link", link).Msg("removing symbolic link")
+		if err := os.Remove(fullpath); err != nil {
+			return err
+		}
+	}
+	// OpenSSL stops looking at the first missing suffix, so the ones after
+	// a removed link move down to close the gap
+	for i, link := range kept {
+		renamed := fmt.Sprintf("%08x.%d", hash, i)
+		if link == renamed {
+			continue
+		}
+		log.Debug().Str("from", link).Str("to", renamed).Msg("renumbering symbolic link")
+		if err := os.Rename(path.Join(dir, link), path.Join(dir, renamed)); err != nil {
+			return err
+		}
+	}
+
+	dstpath := path.Join(dir, "confiar-"+certName(certData)+".pem")
+	if err := os.Remove(dstpath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	log.Info().Str("file", dstpath).Msg("certificate uninstalled")
+	return nil
+}
+
+// hashLinks lists <hash>.0, <hash>.1 and so on, up to the first one missing
+func hashLinks(dir string, hash uint32) ([]string, error) {
+	links := []string{}
+	for i := 0; ; i++ {
+		link := fmt.Sprintf("%08x.%d", hash, i)
+		if _, err := os.Lstat(path.Join(dir, link)); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return links, nil
+			}
+			return nil, err
+		}
+		links = append(links, link)
+	}
+}
+
+func linkHasCertificate(linkPath string, certData *x509.Certificate) bool {
+	data, err := os.ReadFile(linkPath)
+	if err != nil {
+		return false
+	}
+	linked, err := certs.ParsePEM(data)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(linked.Raw, certData.Raw)
+}
+
+type canonicalAttribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+// the SET suffix makes encoding/asn1 treat it as SET OF
+type canonicalRDNSET []canonicalAttribute
+
+// subjectHash is OpenSSL's X509_NAME_hash: the first four bytes, little
+// endian, of the SHA-1 of the subject in canonical form. That is every
+// string attribute as lowercase UTF8String with whitespace trimmed and
+// collapsed, the RDN sets encoded one after another without the outer
+// SEQUENCE.
+func subjectHash(certData *x509.Certificate) (uint32, error) {
+	var rdns []canonicalRDNSET
+	if rest, err := asn1.Unmarshal(certData.RawSubject, &rdns); err != nil {
+		return 0, fmt.Errorf("unable to parse subject: %w", err)
+	} else if len(rest) > 0 {
+		return 0, fmt.Errorf("trailing data after subject")
+	}
+
+	var canonical []byte
+	for _, rdn := range rdns {
+		encoded := [][]byte{}
+		for _, attribute := range rdn {
+			if value, ok := canonicalString(attribute.Value); ok {
+				attribute.Value = asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte(value)}
+			}
+			der, err := asn1.Marshal(attribute)
+			if err != nil {
+				return 0, err
+			}
+			encoded = append(encoded, der)
+		}
+		// DER orders SET OF by encoding
+		sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 })
+		set, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(encoded, nil)})
+		if err != nil {
+			return 0, err
+		}
+		canonical = append(canonical, set...)
+	}
+
+	sum := sha1.Sum(canonical)
+	return binary.LittleEndian.Uint32(sum[:4]), nil
+}
+
+// canonicalString converts the string types OpenSSL canonicalizes to UTF-8,
+// lowercases ASCII letters and normalizes whitespace. Other values are left
+// alone and reported as not ok.
+func canonicalString(value asn1.RawValue) (string, bool) {
+	if value.Class != asn1.ClassUniversal {
+		return "", false
+	}
+	var s string
+	switch value.Tag {
+	case asn1.TagUTF8String, asn1.TagPrintableString, asn1.TagIA5String, 26: // VisibleString
+		s = string(value.Bytes)
+	case asn1.TagT61String:
+		// treated as Latin-1 by OpenSSL
+		runes := make([]rune, len(value.Bytes))
+		for i, b := range value.Bytes {
+			runes[i] = rune(b)
+		}
+		s = string(runes)
+	case asn1.TagBMPString:
+		units := make([]uint16, len(value.Bytes)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(value.Bytes[2*i:])
+		}
+		s = string(utf16.Decode(units))
+	case 28: // UniversalString
+		runes := make([]rune, len(value.Bytes)/4)
+		for i := range runes {
+			runes[i] = rune(binary.BigEndian.Uint32(value.Bytes[4*i:]))
+		}
+		s = string(runes)
+	default:
+		return "", false
+	}
+
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == ' ' || (c >= '\t' && c <= '\r') {
+			space = true
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), true
+}
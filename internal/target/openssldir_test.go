@@ -0,0 +1,182 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	oidCountry      = asn1.ObjectIdentifier{2, 5, 4, 6}
+	oidState        = asn1.ObjectIdentifier{2, 5, 4, 8}
+	oidOrganization = asn1.ObjectIdentifier{2, 5, 4, 10}
+	oidUnit         = asn1.ObjectIdentifier{2, 5, 4, 11}
+	oidCommonName   = asn1.ObjectIdentifier{2, 5, 4, 3}
+	oidEmail        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+)
+
+func typedString(tag int, value string) asn1.RawValue {
+	return asn1.RawValue{Tag: tag, Bytes: []byte(value)}
+}
+
+func bmpString(value string) asn1.RawValue {
+	b := []byte{}
+	for _, r := range value {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return asn1.RawValue{Tag: asn1.TagBMPString, Bytes: b}
+}
+
+// subjectHashCases have their hash from openssl x509 -hash
+var subjectHashCases = []struct {
+	name    string
+	subject pkix.RDNSequence
+	hash    uint32
+}{
+	{
+		name:    "single",
+		subject: pkix.RDNSequence{{{Type: oidCommonName, Value: "Example Root CA"}}},
+		hash:    0x2ea8c67d,
+	},
+	{
+		name: "multiple RDNs",
+		subject: pkix.RDNSequence{
+			{{Type: oidCountry, Value: "US"}},
+			{{Type: oidState, Value: "California"}},
+			{{Type: oidOrganization, Value: "Confiar"}},
+			{{Type: oidUnit, Value: "Platform"}},
+			{{Type: oidCommonName, Value: "Root"}},
+		},
+		hash: 0x71e0183e,
+	},
+	{
+		name: "mixed case and whitespace",
+		subject: pkix.RDNSequence{
+			{{Type: oidOrganization, Value: "  ConFiar \t  Corp  "}},
+			{{Type: oidCommonName, Value: typedString(asn1.TagUTF8String, "Mixed CASE  Name")}},
+		},
+		hash: 0x32b91f77,
+	},
+	{
+		name: "multi-valued RDN",
+		subject: pkix.RDNSequence{
+			{{Type: oidCountry, Value: "DE"}},
+			{{Type: oidOrganization, Value: "Zeta"}, {Type: oidCommonName, Value: "alpha"}},
+		},
+		hash: 0x2cde67f5,
+	},
+	{
+		name: "string types",
+		subject: pkix.RDNSequence{
+			{{Type: oidOrganization, Value: typedString(asn1.TagT61String, "Caf\xe9 Corp")}},
+			{{Type: oidUnit, Value: bmpString("Überwachung")}},
+			{{Type: oidCommonName, Value: typedString(asn1.TagUTF8String, "Ünïcödé Wurzel")}},
+			{{Type: oidEmail, Value: typedString(asn1.TagIA5String, "Admin@Example.COM")}},
+		},
+		hash: 0x53e3d471,
+	},
+}
+
+func testCertificateWithSubject(t *testing.T, subject pkix.RDNSequence) *x509.Certificate {
+	t.Helper()
+	rawSubject, err := asn1.Marshal(subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		RawSubject:   rawSubject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certData, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certData
+}
+
+func TestSubjectHash(t *testing.T) {
+	_, opensslErr := exec.LookPath("openssl")
+	for _, tc := range subjectHashCases {
+		t.Run(tc.name, func(t *testing.T) {
+			certData := testCertificateWithSubject(t, tc.subject)
+			hash, err := subjectHash(certData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hash != tc.hash {
+				t.Errorf("subjectHash = %08x, want %08x", hash, tc.hash)
+			}
+			if opensslErr != nil {
+				return
+			}
+			cmd := exec.Command("openssl", "x509", "-hash", "-noout")
+			cmd.Stdin = strings.NewReader(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certData.Raw})))
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(string(out)); got != fmt.Sprintf("%08x", hash) {
+				t.Errorf("subjectHash = %08x, openssl x509 -hash = %s", hash, got)
+			}
+		})
+	}
+}
+
+// TestSubjectHashCanonical checks that subjects OpenSSL considers equal for
+// lookups share their hash
+func TestSubjectHashCanonical(t *testing.T) {
+	hashOf := func(subject pkix.RDNSequence) uint32 {
+		hash, err := subjectHash(testCertificateWithSubject(t, subject))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	want := hashOf(pkix.RDNSequence{{{Type: oidCommonName, Value: "example root ca"}}})
+	for _, value := range []interface{}{
+		"Example Root CA",
+		"  EXAMPLE   root\tCA ",
+		typedString(asn1.TagUTF8String, "Example Root CA"),
+		bmpString("Example Root CA"),
+	} {
+		if got := hashOf(pkix.RDNSequence{{{Type: oidCommonName, Value: value}}}); got != want {
+			t.Errorf("hash of %q = %08x, want %08x", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+// anchors is shared with other packages, hence the prefix
+var rhelTrust = &trustStore{
+	name:          "rhel",
+	certDir:       "/etc/pki/ca-trust/source/anchors",
+	certFile:      "confiar-%s.crt",
+	updateCommand: []string{"update-ca-trust", "extract"},
+	bundle:        "/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+}
+
+// RHEL covers Fedora, CentOS and other distributions using ca-certificates
+// from the RHEL family, which manage trust through p11-kit.
+type RHEL struct {
+	CertPath string
+	Root     string
+	Runner   Runner
+}
+
+func (r *RHEL) Install() error {
+	return rhelTrust.install(r.CertPath, r.Root, r.Runner)
+}
+
+func (r *RHEL) Uninstall() error {
+	return rhelTrust.uninstall(r.CertPath, r.Root, r.Runner)
+}
@@ -0,0 +1,40 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+var suseTrust = &trustStore{
+	name:          "suse",
+	certDir:       "/etc/pki/trust/anchors",
+	certFile:      "confiar-%s.crt",
+	updateCommand: []string{"update-ca-certificates"},
+	bundle:        "/var/lib/ca-certificates/ca-bundle.pem",
+}
+
+// SUSE covers both openSUSE and SUSE Linux Enterprise.
+type SUSE struct {
+	CertPath string
+	Root     string
+	Runner   Runner
+}
+
+func (s *SUSE) Install() error {
+	return suseTrust.install(s.CertPath, s.Root, s.Runner)
+}
+
+func (s *SUSE) Uninstall() error {
+	return suseTrust.uninstall(s.CertPath, s.Root, s.Runner)
+}
@@ -0,0 +1,186 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// osReleasePaths in order of precedence, see os-release(5)
+var osReleasePaths = []string{"/etc/os-release", "/usr/lib/os-release"}
+
+// distroTrust maps os-release IDs to their trust store, derivatives not listed
+// here are matched through ID_LIKE
+var distroTrust = map[string]*trustStore{
+	"debian": debianTrust,
+	"ubuntu": debianTrust,
+
+	"rhel":   rhelTrust,
+	"fedora": rhelTrust,
+	"centos": rhelTrust,
+
+	"alpine": alpineTrust,
+
+	"arch": archTrust,
+
+	"suse":     suseTrust,
+	"opensuse": suseTrust,
+	"sles":     suseTrust,
+}
+
+// System installs into the trust store of whichever distribution it finds.
+type System struct {
+	CertPath string
+	Root     string
+	Runner   Runner
+}
+
+func (s *System) Install() error {
+	store, err := detectTrustStore(s.Root)
+	if err != nil {
+		return err
+	}
+	return store.install(s.CertPath, s.Root, s.Runner)
+}
+
+func (s *System) Uninstall() error {
+	store, err := detectTrustStore(s.Root)
+	if err != nil {
+		return err
+	}
+	return store.uninstall(s.CertPath, s.Root, s.Runner)
+}
+
+// SystemFiles lists the files System reads from Root, for callers assembling
+// a root out of something other than a directory, such as image layers
+func SystemFiles() []string {
+	files := append([]string{}, osReleasePaths...)
+	seen := map[string]bool{}
+	for _, store := range distroTrust {
+		if !seen[store.bundle] {
+			seen[store.bundle] = true
+			files = append(files, store.bundle)
+		}
+	}
+	sort.Strings(files[len(osReleasePaths):])
+	return files
+}
+
+func detectTrustStore(root string) (*trustStore, error) {
+	release, err := readOSRelease(root)
+	if err != nil {
+		return nil, err
+	}
+	id := release["ID"]
+	idLike := strings.Fields(release["ID_LIKE"])
+	log.Debug().Str("ID", id).Strs("ID_LIKE", idLike).Msg("detected operating system")
+
+	for _, candidate := range append([]string{id}, idLike...) {
+		if store, ok := distroTrust[candidate]; ok {
+			log.Debug().Str("match", candidate).Str("store", store.name).Msg("detected trust store")
+			return store, nil
+		}
+	}
+
+	supported := make([]string, 0, len(distroTrust))
+	for candidate := range distroTrust {
+		supported = append(supported, candidate)
+	}
+	sort.Strings(supported)
+	return nil, fmt.Errorf("unsupported operating system ID=%q ID_LIKE=%q, supported IDs: %s",
+		id, release["ID_LIKE"], strings.Join(supported, ", "))
+}
+
+func readOSRelease(root string) (map[string]string, error) {
+	for _, releasePath := range osReleasePaths {
+		file, err := os.Open(rootPath(root, releasePath))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		release := map[string]string{}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			key, value, found := cut(line, "=")
+			if !found {
+				continue
+			}
+			release[key] = unquote(value)
+		}
+		return release, scanner.Err()
+	}
+	return nil, fmt.Errorf("unable to detect operating system, none of %s exist", strings.Join(osReleasePaths, ", "))
+}
+
+func cut(s string, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	return strings.NewReplacer(`\"`, `"`, `\\`, `\`, `\$`, `$`, "\\`", "`").Replace(value)
+}
+
+// TrustAnchor describes installing a certificate into a trust store by other
+// means than a target, such as a package
+type TrustAnchor struct {
+	// Store names the trust store layout, such as debian or rhel
+	Store string
+	// Path is where the trust store picks the certificate up from
+	Path          string
+	UpdateCommand []string
+	// RemoveCommand updates the trust store once Path is gone
+	RemoveCommand []string
+}
+
+func NewTrustAnchor(distro string, certData *x509.Certificate) (*TrustAnchor, error) {
+	store, ok := distroTrust[distro]
+	if !ok {
+		return nil, fmt.Errorf("unsupported distribution: %s", distro)
+	}
+	anchor := &TrustAnchor{
+		Store:         store.name,
+		Path:          path.Join(store.certDir, fmt.Sprintf(store.certFile, certName(certData))),
+		UpdateCommand: append([]string{}, store.updateCommand...),
+		RemoveCommand: append([]string{}, store.updateCommand...),
+	}
+	if store.removeCommand != nil {
+		anchor.RemoveCommand = append([]string{}, store.removeCommand...)
+	}
+	return anchor, nil
+}
@@ -0,0 +1,178 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func writeOSRelease(t *testing.T, root string, releasePath string, content string) {
+	t.Helper()
+	fullpath := rootPath(root, releasePath)
+	if err := os.MkdirAll(path.Dir(fullpath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fullpath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the os-release files are trimmed from what the distributions ship
+var osReleaseCases = []struct {
+	name      string
+	osRelease string
+	store     *trustStore
+}{
+	{
+		name: "ubuntu",
+		osRelease: `PRETTY_NAME="Ubuntu 22.04.4 LTS"
+NAME="Ubuntu"
+VERSION_ID="22.04"
+ID=ubuntu
+ID_LIKE=debian
+`,
+		store: debianTrust,
+	},
+	{
+		name: "rocky",
+		osRelease: `NAME="Rocky Linux"
+VERSION="9.3 (Blue Onyx)"
+ID="rocky"
+ID_LIKE="rhel centos fedora"
+VERSION_ID="9.3"
+`,
+		store: rhelTrust,
+	},
+	{
+		name: "almalinux",
+		osRelease: `NAME="AlmaLinux"
+VERSION="9.3 (Shamrock Pampas Cat)"
+ID="almalinux"
+ID_LIKE="rhel centos fedora"
+`,
+		store: rhelTrust,
+	},
+	{
+		name: "opensuse-leap",
+		osRelease: `NAME="openSUSE Leap"
+VERSION="15.5"
+ID="opensuse-leap"
+ID_LIKE="suse opensuse"
+`,
+		store: suseTrust,
+	},
+	{
+		name: "manjaro",
+		osRelease: `NAME="Manjaro Linux"
+ID=manjaro
+ID_LIKE=arch
+# comments and blank lines are skipped
+
+BUILD_ID=rolling
+`,
+		store: archTrust,
+	},
+	{
+		name: "alpine",
+		osRelease: `NAME="Alpine Linux"
+ID=alpine
+VERSION_ID=3.19.1
+`,
+		store: alpineTrust,
+	},
+}
+
+func TestDetectTrustStore(t *testing.T) {
+	for _, tc := range osReleaseCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeOSRelease(t, root, "/etc/os-release", tc.osRelease)
+			store, err := detectTrustStore(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if store != tc.store {
+				t.Errorf("got trust store %s, want %s", store.name, tc.store.name)
+			}
+		})
+	}
+}
+
+func TestDetectTrustStoreUsrLib(t *testing.T) {
+	root := t.TempDir()
+	writeOSRelease(t, root, "/usr/lib/os-release", "ID=debian\n")
+	store, err := detectTrustStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store != debianTrust {
+		t.Errorf("got trust store %s, want debian", store.name)
+	}
+
+	// /etc/os-release takes precedence
+	writeOSRelease(t, root, "/etc/os-release", "ID=fedora\n")
+	if store, err := detectTrustStore(root); err != nil || store != rhelTrust {
+		t.Errorf("got trust store %v (%v), want rhel", store, err)
+	}
+}
+
+func TestDetectTrustStoreUnsupported(t *testing.T) {
+	root := t.TempDir()
+	writeOSRelease(t, root, "/etc/os-release", `NAME=NixOS
+ID=nixos
+`)
+	_, err := detectTrustStore(root)
+	if err == nil {
+		t.Fatal("expected an error for an unsupported distribution")
+	}
+	for candidate := range distroTrust {
+		if !strings.Contains(err.Error(), candidate) {
+			t.Errorf("error %q does not list %s", err, candidate)
+		}
+	}
+	if !strings.Contains(err.Error(), `ID="nixos"`) {
+		t.Errorf("error %q does not name the detected ID", err)
+	}
+
+	if _, err := detectTrustStore(t.TempDir()); err == nil || !strings.Contains(err.Error(), "/etc/os-release") {
+		t.Errorf("got error %v without os-release", err)
+	}
+}
+
+func TestSystemInstall(t *testing.T) {
+	root := t.TempDir()
+	writeOSRelease(t, root, "/etc/os-release", osReleaseCases[0].osRelease)
+	certPath, certData := writeTestCertificate(t, t.TempDir())
+	runner := &fakeRunner{root: root, certDir: debianTrust.certDir, bundle: debianTrust.bundle}
+	system := &System{CertPath: certPath, Root: root, Runner: runner}
+
+	if err := system.Install(); err != nil {
+		t.Fatal(err)
+	}
+	if n := bundleCount(t, rootPath(root, debianTrust.bundle), certData); n != 1 {
+		t.Errorf("got %d copies in the debian bundle, want 1", n)
+	}
+	if err := system.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	if n := bundleCount(t, rootPath(root, debianTrust.bundle), certData); n != 0 {
+		t.Errorf("certificate is still in the debian bundle after uninstall")
+	}
+}
@@ -0,0 +1,204 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/wilsonehusin/confiar/internal/certs"
+)
+
+// trustStore describes how a distribution manages its system-wide certificate
+// authorities: a directory of local certificates which gets compiled into a
+// bundle by a command.
+type trustStore struct {
+	name string
+
+	// certDir holds certFile, a format string given the certificate name
+	certDir  string
+	certFile string
+
+	updateCommand []string
+	bundle        string
+
+	// removeCommand replaces updateCommand after a certificate was removed,
+	// for tools which otherwise leave stale links behind
+	removeCommand []string
+
+	// appendFallback allows adding to the bundle directly when updateCommand
+	// is not installed, the bundle is then only as fresh as this certificate
+	appendFallback bool
+}
+
+func (t *trustStore) install(certPath string, root string, runner Runner) error {
+	certBytes, certData, err := readCertificate(certPath)
+	if err != nil {
+		return err
+	}
+	logger := log.With().Str("store", t.name).Logger()
+
+	certDir := rootPath(root, t.certDir)
+	logger.Debug().Str("path", certDir).Msg("creating directory")
+	if err := os.MkdirAll(certDir, 0755); err != nil {
+		return err
+	}
+
+	dstpath := path.Join(certDir, fmt.Sprintf(t.certFile, certName(certData)))
+	logger.Debug().Str("file", dstpath).Msg("writing certificate")
+	if err := os.WriteFile(dstpath, certBytes, 0644); err != nil {
+		return err
+	}
+
+	bundle := rootPath(root, t.bundle)
+	runner = runnerOrDefault(runner, root)
+	if _, err := runner.LookPath(t.updateCommand[0]); err != nil && t.appendFallback {
+		logger.Warn().Err(err).Str("bundle", bundle).Msg("trust store tooling not found, appending to bundle instead")
+		if err := appendToBundle(bundle, certBytes, certData); err != nil {
+			return err
+		}
+	} else {
+		logger.Debug().Strs("command", t.updateCommand).Msg("updating trust store")
+		err := runner.Run(t.updateCommand[0], t.updateCommand[1:]...)
+		if errors.Is(err, ErrCommandSkipped) {
+			// the bundle is regenerated with the certificate once the
+			// command runs, until then it is trusted through the bundle
+			logger.Warn().Str("bundle", bundle).Msg("trust store update skipped, appending to bundle instead")
+			err = appendToBundle(bundle, certBytes, certData)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to update trust store: %w", err)
+		}
+	}
+
+	found, err := bundleContains(bundle, certData)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("certificate is missing from %s after update", bundle)
+	}
+
+	logger.Info().Str("file", dstpath).Str("bundle", bundle).Msg("certificate installed")
+	return nil
+}
+
+func (t *trustStore) uninstall(certPath string, root string, runner Runner) error {
+	_, certData, err := readCertificate(certPath)
+	if err != nil {
+		return err
+	}
+	logger := log.With().Str("store", t.name).Logger()
+
+	dstpath := path.Join(rootPath(root, t.certDir), fmt.Sprintf(t.certFile, certName(certData)))
+	logger.Debug().Str("file", dstpath).Msg("removing certificate")
+	if err := os.Remove(dstpath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	command := t.updateCommand
+	if t.removeCommand != nil {
+		command = t.removeCommand
+	}
+	bundle := rootPath(root, t.bundle)
+	runner = runnerOrDefault(runner, root)
+	if _, err := runner.LookPath(command[0]); err != nil && t.appendFallback {
+		logger.Warn().Err(err).Str("bundle", bundle).Msg("trust store tooling not found, removing from bundle instead")
+		if err := removeFromBundle(bundle, certData); err != nil {
+			return err
+		}
+	} else {
+		logger.Debug().Strs("command", command).Msg("updating trust store")
+		err := runner.Run(command[0], command[1:]...)
+		if errors.Is(err, ErrCommandSkipped) {
+			logger.Warn().Str("bundle", bundle).Msg("trust store update skipped, removing from bundle instead")
+			err = removeFromBundle(bundle, certData)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to update trust store: %w", err)
+		}
+	}
+
+	found, err := bundleContains(bundle, certData)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if found {
+		return fmt.Errorf("certificate is still in %s after update", bundle)
+	}
+
+	logger.Info().Str("file", dstpath).Str("bundle", bundle).Msg("certificate uninstalled")
+	return nil
+}
+
+// appendToBundle adds the certificate to the end of bundlePath, unless it is
+// already part of the bundle
+func appendToBundle(bundlePath string, certBytes []byte, certData *x509.Certificate) error {
+	if found, err := bundleContains(bundlePath, certData); err == nil && found {
+		log.Debug().Str("bundle", bundlePath).Msg("certificate already in bundle")
+		return nil
+	}
+
+	if err := os.MkdirAll(path.Dir(bundlePath), 0755); err != nil {
+		return err
+	}
+	bundle, err := os.OpenFile(bundlePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := bundle.Stat()
+	if err != nil {
+		bundle.Close()
+		return err
+	}
+	if info.Size() > 0 {
+		// a bundle without trailing newline would glue the PEM blocks together
+		if _, err := bundle.Write([]byte("\n")); err != nil {
+			bundle.Close()
+			return err
+		}
+	}
+	if _, err := bundle.Write(certBytes); err != nil {
+		bundle.Close()
+		return err
+	}
+	return bundle.Close()
+}
+
+// removeFromBundle takes the certificate out of bundlePath, leaving the rest
+// of the bundle as it is
+func removeFromBundle(bundlePath string, certData *x509.Certificate) error {
+	bundle, err := os.ReadFile(bundlePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	kept, removed := certs.BundleWithout(bundle, certData.Raw)
+	if !removed {
+		log.Debug().Str("bundle", bundlePath).Msg("certificate not in bundle")
+		return nil
+	}
+	return os.WriteFile(bundlePath, kept, 0644)
+}
@@ -0,0 +1,367 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a certificate for registry.corp to dir
+func writeTestCertificate(t *testing.T, dir string) (string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "registry.corp"},
+		DNSNames:              []string{"registry.corp"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certData, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := path.Join(dir, "cert.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, certData
+}
+
+// fakeRunner records commands and compiles the bundle out of the system
+// certificates and every file in certDir, the way the distribution tooling
+// would
+type fakeRunner struct {
+	root    string
+	certDir string
+	bundle  string
+	system  []byte
+
+	missing bool // commands are not installed
+	skip    bool // behaves like --skip-commands
+	broken  bool // runs without updating the bundle
+
+	calls [][]string
+}
+
+func (f *fakeRunner) LookPath(name string) (string, error) {
+	if f.missing {
+		return "", fmt.Errorf("%s: %w", name, exec.ErrNotFound)
+	}
+	return "/usr/sbin/" + name, nil
+}
+
+func (f *fakeRunner) Run(name string, args ...string) error {
+	f.calls = append(f.calls, append([]string{name}, args...))
+	if f.skip {
+		return fmt.Errorf("%s: %w", name, ErrCommandSkipped)
+	}
+	if f.broken {
+		return nil
+	}
+	bundle := append([]byte{}, f.system...)
+	entries, err := os.ReadDir(rootPath(f.root, f.certDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(path.Join(rootPath(f.root, f.certDir), entry.Name()))
+		if err != nil {
+			return err
+		}
+		bundle = append(bundle, data...)
+	}
+	return writeBundle(rootPath(f.root, f.bundle), bundle)
+}
+
+func writeBundle(bundlePath string, data []byte) error {
+	if err := os.MkdirAll(path.Dir(bundlePath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(bundlePath, data, 0644)
+}
+
+// bundleCount counts the copies of certData in the bundle at bundlePath
+func bundleCount(t *testing.T, bundlePath string, certData *x509.Certificate) int {
+	t.Helper()
+	data, err := os.ReadFile(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			return count
+		}
+		if bytes.Equal(block.Bytes, certData.Raw) {
+			count++
+		}
+		data = rest
+	}
+}
+
+type systemTarget interface {
+	Target
+	Uninstaller
+}
+
+var systemTrustCases = []struct {
+	name      string
+	newTarget func(certPath string, root string, runner Runner) systemTarget
+	certDir   string
+	anchor    string
+	install   []string
+	uninstall []string
+	bundle    string
+}{
+	{
+		name: "debian",
+		newTarget: func(certPath string, root string, runner Runner) systemTarget {
+			return &Debian{CertPath: certPath, Root: root, Runner: runner}
+		},
+		certDir:   "/usr/local/share/ca-certificates/confiar",
+		anchor:    "/usr/local/share/ca-certificates/confiar/registry.corp.crt",
+		install:   []string{"update-ca-certificates"},
+		uninstall: []string{"update-ca-certificates", "--fresh"},
+		bundle:    "/etc/ssl/certs/ca-certificates.crt",
+	},
+	{
+		name: "rhel",
+		newTarget: func(certPath string, root string, runner Runner) systemTarget {
+			return &RHEL{CertPath: certPath, Root: root, Runner: runner}
+		},
+		certDir:   "/etc/pki/ca-trust/source/anchors",
+		anchor:    "/etc/pki/ca-trust/source/anchors/confiar-registry.corp.crt",
+		install:   []string{"update-ca-trust", "extract"},
+		uninstall: []string{"update-ca-trust", "extract"},
+		bundle:    "/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	},
+	{
+		name: "alpine",
+		newTarget: func(certPath string, root string, runner Runner) systemTarget {
+			return &Alpine{CertPath: certPath, Root: root, Runner: runner}
+		},
+		certDir:   "/usr/local/share/ca-certificates",
+		anchor:    "/usr/local/share/ca-certificates/confiar-registry.corp.crt",
+		install:   []string{"update-ca-certificates"},
+		uninstall: []string{"update-ca-certificates"},
+		bundle:    "/etc/ssl/certs/ca-certificates.crt",
+	},
+	{
+		name: "arch",
+		newTarget: func(certPath string, root string, runner Runner) systemTarget {
+			return &Arch{CertPath: certPath, Root: root, Runner: runner}
+		},
+		certDir:   "/etc/ca-certificates/trust-source/anchors",
+		anchor:    "/etc/ca-certificates/trust-source/anchors/confiar-registry.corp.crt",
+		install:   []string{"trust", "extract-compat"},
+		uninstall: []string{"trust", "extract-compat"},
+		bundle:    "/etc/ca-certificates/extracted/tls-ca-bundle.pem",
+	},
+	{
+		name: "suse",
+		newTarget: func(certPath string, root string, runner Runner) systemTarget {
+			return &SUSE{CertPath: certPath, Root: root, Runner: runner}
+		},
+		certDir:   "/etc/pki/trust/anchors",
+		anchor:    "/etc/pki/trust/anchors/confiar-registry.corp.crt",
+		install:   []string{"update-ca-certificates"},
+		uninstall: []string{"update-ca-certificates"},
+		bundle:    "/var/lib/ca-certificates/ca-bundle.pem",
+	},
+}
+
+func TestSystemTrust(t *testing.T) {
+	systemCAData := testCertificateWithSubject(t, pkix.RDNSequence{{{Type: oidCommonName, Value: "System Root CA"}}})
+	systemCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: systemCAData.Raw})
+
+	for _, tc := range systemTrustCases {
+		newRunner := func(root string) *fakeRunner {
+			return &fakeRunner{root: root, certDir: tc.certDir, bundle: tc.bundle, system: systemCA}
+		}
+
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			certPath, certData := writeTestCertificate(t, t.TempDir())
+			runner := newRunner(root)
+			target := tc.newTarget(certPath, root, runner)
+
+			if err := target.Install(); err != nil {
+				t.Fatal(err)
+			}
+			anchor, err := os.ReadFile(rootPath(root, tc.anchor))
+			if err != nil {
+				t.Fatalf("anchor was not written: %v", err)
+			}
+			if block, _ := pem.Decode(anchor); block == nil || !bytes.Equal(block.Bytes, certData.Raw) {
+				t.Errorf("anchor does not hold the certificate")
+			}
+			if want := [][]string{tc.install}; !reflect.DeepEqual(runner.calls, want) {
+				t.Errorf("got commands %q, want %q", runner.calls, want)
+			}
+
+			if err := target.Install(); err != nil {
+				t.Fatalf("second install: %v", err)
+			}
+			if n := bundleCount(t, rootPath(root, tc.bundle), certData); n != 1 {
+				t.Errorf("got %d copies in the bundle after a second install, want 1", n)
+			}
+			if entries, err := os.ReadDir(rootPath(root, tc.certDir)); err != nil || len(entries) != 1 {
+				t.Errorf("got %d anchors after a second install, want 1 (%v)", len(entries), err)
+			}
+
+			if err := target.Uninstall(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(rootPath(root, tc.anchor)); !os.IsNotExist(err) {
+				t.Errorf("anchor still exists after uninstall: %v", err)
+			}
+			if last := runner.calls[len(runner.calls)-1]; !reflect.DeepEqual(last, tc.uninstall) {
+				t.Errorf("got command %q on uninstall, want %q", last, tc.uninstall)
+			}
+			if n := bundleCount(t, rootPath(root, tc.bundle), certData); n != 0 {
+				t.Errorf("certificate is still in the bundle after uninstall")
+			}
+			if err := target.Uninstall(); err != nil {
+				t.Errorf("uninstalling twice: %v", err)
+			}
+		})
+
+		t.Run(tc.name+" bundle not updated", func(t *testing.T) {
+			root := t.TempDir()
+			certPath, _ := writeTestCertificate(t, t.TempDir())
+			if err := writeBundle(rootPath(root, tc.bundle), systemCA); err != nil {
+				t.Fatal(err)
+			}
+			runner := newRunner(root)
+			runner.broken = true
+
+			err := tc.newTarget(certPath, root, runner).Install()
+			if err == nil || !strings.Contains(err.Error(), "missing from") {
+				t.Errorf("got error %v, want the certificate missing from the bundle", err)
+			}
+		})
+
+		t.Run(tc.name+" skip commands", func(t *testing.T) {
+			root := t.TempDir()
+			certPath, certData := writeTestCertificate(t, t.TempDir())
+			// no trailing newline, so the appended block must not be glued on
+			if err := writeBundle(rootPath(root, tc.bundle), bytes.TrimSpace(systemCA)); err != nil {
+				t.Fatal(err)
+			}
+			runner := newRunner(root)
+			runner.skip = true
+			target := tc.newTarget(certPath, root, runner)
+
+			for i := 0; i < 2; i++ {
+				if err := target.Install(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := os.Stat(rootPath(root, tc.anchor)); err != nil {
+				t.Errorf("anchor was not written: %v", err)
+			}
+			bundle := rootPath(root, tc.bundle)
+			if n := bundleCount(t, bundle, certData); n != 1 {
+				t.Errorf("got %d copies in the bundle, want 1", n)
+			}
+			if n := bundleCount(t, bundle, systemCAData); n != 1 {
+				t.Errorf("system certificate was lost from the bundle")
+			}
+
+			if err := target.Uninstall(); err != nil {
+				t.Fatal(err)
+			}
+			if n := bundleCount(t, bundle, certData); n != 0 {
+				t.Errorf("certificate is still in the bundle after uninstall")
+			}
+			if n := bundleCount(t, bundle, systemCAData); n != 1 {
+				t.Errorf("system certificate was removed from the bundle")
+			}
+		})
+	}
+}
+
+func TestAlpineWithoutTooling(t *testing.T) {
+	systemCAData := testCertificateWithSubject(t, pkix.RDNSequence{{{Type: oidCommonName, Value: "System Root CA"}}})
+	systemCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: systemCAData.Raw})
+
+	root := t.TempDir()
+	bundle := rootPath(root, "/etc/ssl/certs/ca-certificates.crt")
+	if err := writeBundle(bundle, systemCA); err != nil {
+		t.Fatal(err)
+	}
+	certPath, certData := writeTestCertificate(t, t.TempDir())
+	runner := &fakeRunner{root: root, missing: true}
+	alpine := &Alpine{CertPath: certPath, Root: root, Runner: runner}
+
+	for i := 0; i < 2; i++ {
+		if err := alpine.Install(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(runner.calls) != 0 {
+		t.Errorf("ran %q without update-ca-certificates installed", runner.calls)
+	}
+	if _, err := os.Stat(rootPath(root, "/usr/local/share/ca-certificates/confiar-registry.corp.crt")); err != nil {
+		t.Errorf("anchor was not written: %v", err)
+	}
+	if n := bundleCount(t, bundle, certData); n != 1 {
+		t.Errorf("got %d copies in the bundle after installing twice, want 1", n)
+	}
+	if n := bundleCount(t, bundle, systemCAData); n != 1 {
+		t.Errorf("system certificate was lost from the bundle")
+	}
+
+	if err := alpine.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	if n := bundleCount(t, bundle, certData); n != 0 {
+		t.Errorf("certificate is still in the bundle after uninstall")
+	}
+	if n := bundleCount(t, bundle, systemCAData); n != 1 {
+		t.Errorf("system certificate was removed from the bundle")
+	}
+}
@@ -20,3 +20,9 @@ package target
 type Target interface {
 	Install() error
 }
+
+// Uninstaller is implemented by targets which are able to remove what they
+// have installed
+type Uninstaller interface {
+	Uninstall() error
+}
@@ -0,0 +1,567 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// tomlDocument edits TOML in place, so that comments, ordering and formatting
+// of everything it does not touch are kept. Deciding what to change is left
+// to decoding the document, this only finds tables by their [header] lines and
+// keys within them, values set through inline tables or dotted keys are not
+// found and reported as errors.
+type tomlDocument struct {
+	src string
+}
+
+// tomlSection is the root table, index 0, or a table starting at a header
+type tomlSection struct {
+	path  []string
+	array bool
+	// owner is the section of the [[array]] element this is a subtable of,
+	// -1 when there is none
+	owner int
+
+	headerStart int
+	// bodyStart is after the header line, end at the next header
+	bodyStart int
+	end       int
+	indent    string
+	keys      []tomlKey
+}
+
+type tomlKey struct {
+	path       []string
+	lineStart  int
+	valueStart int
+	value      tomlValueSpan
+	lineEnd    int
+}
+
+type tomlValueSpan struct {
+	end int
+	// for arrays, where the closing bracket is and whether elements need a
+	// comma before another one is added
+	closing   int
+	needComma bool
+}
+
+func (d *tomlDocument) Bytes() []byte {
+	return []byte(d.src)
+}
+
+// check decodes the edited document, catching tables which were added again
+// because they are already defined in a way edits do not find
+func (d *tomlDocument) check() error {
+	if err := toml.Unmarshal([]byte(d.src), &map[string]interface{}{}); err != nil {
+		return fmt.Errorf("unable to edit in place: %w", err)
+	}
+	return nil
+}
+
+// arrayTables returns the sections of every [[path]] element in order
+func (d *tomlDocument) arrayTables(path []string) ([]int, error) {
+	sections, err := d.sections()
+	if err != nil {
+		return nil, err
+	}
+	found := []int{}
+	for i, section := range sections {
+		if section.array && equalPath(section.path, path) {
+			found = append(found, i)
+		}
+	}
+	return found, nil
+}
+
+// set replaces the value of key in the table at path, a subtable of the array
+// element at section owner unless that is -1, adding the key or the table when
+// missing
+func (d *tomlDocument) set(path []string, owner int, key string, value string) error {
+	return d.edit(path, owner, key, value, false)
+}
+
+// appendTo adds value to the array at key, see set
+func (d *tomlDocument) appendTo(path []string, owner int, key string, value string) error {
+	return d.edit(path, owner, key, value, true)
+}
+
+func (d *tomlDocument) edit(path []string, owner int, key string, value string, appendValue bool) error {
+	sections, err := d.sections()
+	if err != nil {
+		return err
+	}
+	newValue := value
+	if appendValue {
+		newValue = "[" + value + "]"
+	}
+
+	section := -1
+	for i, candidate := range sections {
+		if equalPath(candidate.path, path) && candidate.owner == owner && (i == 0 || !candidate.array) {
+			section = i
+			break
+		}
+	}
+	if section < 0 {
+		if len(path) == 0 {
+			return fmt.Errorf("unable to find the root table")
+		}
+		return d.addTable(sections, path, owner, key, newValue)
+	}
+
+	s := sections[section]
+	for _, existing := range s.keys {
+		if len(existing.path) > 1 && existing.path[0] == key {
+			return fmt.Errorf("unable to edit %s in place, it is set through dotted keys", tomlHeader(append(path, key)))
+		}
+		if len(existing.path) != 1 || existing.path[0] != key {
+			continue
+		}
+		if !appendValue {
+			d.replace(existing.valueStart, existing.value.end, value)
+			return nil
+		}
+		if existing.value.closing < 0 {
+			return fmt.Errorf("expected an array at %s", tomlHeader(append(path, key)))
+		}
+		// right after the last element, before any comment or newline
+		at := lastSignificant(d.src, existing.valueStart, existing.value.closing)
+		insert := value
+		if existing.value.needComma {
+			insert = ", " + value
+		} else if d.src[at-1] == ',' {
+			insert = " " + value + ","
+		}
+		d.replace(at, at, insert)
+		return nil
+	}
+
+	line := tomlKeyName(key) + " = " + newValue + "\n"
+	switch {
+	case len(s.keys) > 0:
+		last := s.keys[len(s.keys)-1]
+		indent := leadingSpace(d.src[last.lineStart:])
+		d.replace(last.lineEnd, last.lineEnd, d.newlineAt(last.lineEnd)+indent+line)
+	case section == 0:
+		d.replace(0, 0, line)
+	default:
+		d.replace(s.bodyStart, s.bodyStart, d.newlineAt(s.bodyStart)+s.indent+line)
+	}
+	return nil
+}
+
+// addTable appends the table with key to the end of the document, or the end
+// of the array element owning it
+func (d *tomlDocument) addTable(sections []tomlSection, path []string, owner int, key string, value string) error {
+	at := len(d.src)
+	indent := ""
+	if owner >= 0 {
+		indent = sections[owner].indent + "  "
+		at = sections[owner].end
+		for i := owner + 1; i < len(sections) && sections[i].owner == owner; i++ {
+			at = sections[i].end
+		}
+	}
+	table := indent + "[" + tomlHeader(path) + "]\n" + indent + "  " + tomlKeyName(key) + " = " + value + "\n"
+	prefix := d.newlineAt(at)
+	if at > 0 && !strings.HasSuffix(d.src[:at], "\n\n") {
+		prefix += "\n"
+	}
+	if at == 0 {
+		prefix = ""
+	}
+	suffix := ""
+	if at < len(d.src) {
+		suffix = "\n"
+	}
+	d.replace(at, at, prefix+table+suffix)
+	return nil
+}
+
+// newlineAt is needed before inserting a line at offset when the previous
+// line has no line break, which only happens at the end of the document
+func (d *tomlDocument) newlineAt(offset int) string {
+	if offset > 0 && d.src[offset-1] != '\n' {
+		return "\n"
+	}
+	return ""
+}
+
+func (d *tomlDocument) replace(start, end int, text string) {
+	d.src = d.src[:start] + text + d.src[end:]
+}
+
+func (d *tomlDocument) sections() ([]tomlSection, error) {
+	sections := []tomlSection{{owner: -1}}
+	current := &sections[0]
+	src := d.src
+	for i := 0; i < len(src); {
+		lineStart := i
+		i = skipSpace(src, i)
+		switch {
+		case i >= len(src):
+		case src[i] == '\n' || src[i] == '\r':
+		case src[i] == '#':
+			i = skipLine(src, i)
+			continue
+		case src[i] == '[':
+			array := strings.HasPrefix(src[i:], "[[")
+			start := i + 1
+			if array {
+				start++
+			}
+			path, next, err := parseTOMLKey(src, start)
+			if err != nil {
+				return nil, err
+			}
+			closing := "]"
+			if array {
+				closing = "]]"
+			}
+			next = skipSpace(src, next)
+			if !strings.HasPrefix(src[next:], closing) {
+				return nil, fmt.Errorf("malformed table header at offset %d", lineStart)
+			}
+			current.end = lineStart
+			section := tomlSection{
+				path:        path,
+				array:       array,
+				owner:       -1,
+				headerStart: lineStart,
+				indent:      src[lineStart:skipSpace(src, lineStart)],
+			}
+			// subtables of the latest element of an enclosing array
+			for j := len(sections) - 1; j > 0; j-- {
+				if sections[j].array && len(sections[j].path) < len(path) && equalPath(sections[j].path, path[:len(sections[j].path)]) {
+					section.owner = j
+					break
+				}
+			}
+			i = skipLine(src, next+len(closing))
+			section.bodyStart = i
+			sections = append(sections, section)
+			current = &sections[len(sections)-1]
+			continue
+		default:
+			path, next, err := parseTOMLKey(src, i)
+			if err != nil {
+				return nil, err
+			}
+			next = skipSpace(src, next)
+			if next >= len(src) || src[next] != '=' {
+				return nil, fmt.Errorf("expected = after key at offset %d", lineStart)
+			}
+			valueStart := skipSpace(src, next+1)
+			value, err := scanTOMLValue(src, valueStart)
+			if err != nil {
+				return nil, err
+			}
+			i = skipLine(src, value.end)
+			current.keys = append(current.keys, tomlKey{
+				path:       path,
+				lineStart:  lineStart,
+				valueStart: valueStart,
+				value:      value,
+				lineEnd:    i,
+			})
+			continue
+		}
+		i = skipLine(src, i)
+	}
+	current.end = len(src)
+	return sections, nil
+}
+
+var bareTOMLKey = regexp.MustCompile(`^[A-Za-z0-9_-]+`)
+
+// parseTOMLKey reads a possibly dotted and quoted key
+func parseTOMLKey(src string, i int) ([]string, int, error) {
+	path := []string{}
+	for {
+		i = skipSpace(src, i)
+		if i >= len(src) {
+			return nil, i, fmt.Errorf("unexpected end of document in key")
+		}
+		switch src[i] {
+		case '"':
+			end := i + 1
+			for end < len(src) && src[end] != '"' {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) {
+				return nil, i, fmt.Errorf("unterminated key at offset %d", i)
+			}
+			part, err := strconv.Unquote(src[i : end+1])
+			if err != nil {
+				return nil, i, fmt.Errorf("invalid key at offset %d: %w", i, err)
+			}
+			path = append(path, part)
+			i = end + 1
+		case '\'':
+			end := strings.IndexByte(src[i+1:], '\'')
+			if end < 0 {
+				return nil, i, fmt.Errorf("unterminated key at offset %d", i)
+			}
+			path = append(path, src[i+1:i+1+end])
+			i = i + end + 2
+		default:
+			part := bareTOMLKey.FindString(src[i:])
+			if part == "" {
+				return nil, i, fmt.Errorf("invalid key at offset %d", i)
+			}
+			path = append(path, part)
+			i += len(part)
+		}
+		next := skipSpace(src, i)
+		if next >= len(src) || src[next] != '.' {
+			return path, i, nil
+		}
+		i = next + 1
+	}
+}
+
+// scanTOMLValue finds where the value starting at i ends, excluding any
+// trailing comment
+func scanTOMLValue(src string, i int) (tomlValueSpan, error) {
+	span := tomlValueSpan{closing: -1}
+	start := i
+	depth := 0
+	lastSig := i
+	// whether the array at depth 1 has an element after its last comma
+	element := false
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == '\n' && depth == 0:
+			span.end = lastSig
+			return span, nil
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+			continue
+		case c == '#':
+			i = skipLine(src, i)
+			continue
+		case strings.HasPrefix(src[i:], `"""`), strings.HasPrefix(src[i:], "'''"):
+			quote := src[i : i+3]
+			end := i + 3
+			for {
+				next := strings.Index(src[end:], quote)
+				if next < 0 {
+					return span, fmt.Errorf("unterminated string at offset %d", i)
+				}
+				end += next
+				if quote == `"""` && escaped(src, end) {
+					end++
+					continue
+				}
+				break
+			}
+			i = end + 3
+			for i < len(src) && src[i] == quote[0] {
+				i++
+			}
+		case c == '"':
+			i++
+			for i < len(src) && src[i] != '"' && src[i] != '\n' {
+				if src[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(src) || src[i] != '"' {
+				return span, fmt.Errorf("unterminated string at offset %d", start)
+			}
+			i++
+		case c == '\'':
+			end := strings.IndexByte(src[i+1:], '\'')
+			if end < 0 {
+				return span, fmt.Errorf("unterminated string at offset %d", start)
+			}
+			i += end + 2
+		case c == '[' || c == '{':
+			depth++
+			i++
+			if depth == 1 && c == '[' {
+				element = false
+			}
+			lastSig = i
+			continue
+		case c == ']' || c == '}':
+			depth--
+			if depth == 0 && c == ']' && src[start] == '[' {
+				span.closing = i
+				span.needComma = element
+			}
+			i++
+			lastSig = i
+			if depth == 0 {
+				element = false
+			}
+			continue
+		case c == ',':
+			if depth == 1 {
+				element = false
+			}
+			i++
+			lastSig = i
+			continue
+		default:
+			i++
+		}
+		if depth == 1 {
+			element = true
+		}
+		lastSig = i
+		if depth < 0 {
+			return span, fmt.Errorf("unbalanced brackets at offset %d", start)
+		}
+	}
+	if depth != 0 {
+		return span, fmt.Errorf("unterminated value at offset %d", start)
+	}
+	span.end = lastSig
+	return span, nil
+}
+
+// escaped reports whether the character at i is preceded by an odd number of
+// backslashes
+func escaped(src string, i int) bool {
+	n := 0
+	for i > 0 && src[i-1] == '\\' {
+		n++
+		i--
+	}
+	return n%2 == 1
+}
+
+// lastSignificant is the offset after the last character between start and
+// end which is neither whitespace nor part of a comment
+func lastSignificant(src string, start, end int) int {
+	last := start
+	for i := start; i < end; {
+		switch c := src[i]; {
+		case c == '#':
+			i = skipLine(src, i)
+			continue
+		case c == '"' || c == '\'':
+			// strings within the array, the value is known to be well formed
+			quote := c
+			i++
+			for i < end && src[i] != quote {
+				if quote == '"' && src[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			i++
+			last = i
+			continue
+		case c != ' ' && c != '\t' && c != '\r' && c != '\n':
+			last = i + 1
+		}
+		i++
+	}
+	return last
+}
+
+func skipSpace(src string, i int) int {
+	for i < len(src) && (src[i] == ' ' || src[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+// skipLine returns the offset after the next line break
+func skipLine(src string, i int) int {
+	if next := strings.IndexByte(src[i:], '\n'); next >= 0 {
+		return i + next + 1
+	}
+	return len(src)
+}
+
+func leadingSpace(line string) string {
+	return line[:skipSpace(line, 0)]
+}
+
+func equalPath(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func tomlKeyName(key string) string {
+	if bareTOMLKey.FindString(key) == key && key != "" {
+		return key
+	}
+	return tomlString(key)
+}
+
+func tomlHeader(path []string) string {
+	parts := make([]string, len(path))
+	for i, part := range path {
+		parts[i] = tomlKeyName(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// tomlString quotes s as a TOML basic string
+func tomlString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// tomlStrings formats values as an inline array of strings
+func tomlStrings(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = tomlString(value)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
@@ -0,0 +1,260 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTOMLDocumentAppend(t *testing.T) {
+	cases := []struct {
+		name   string
+		before string
+		after  string
+	}{
+		{
+			name:   "empty",
+			before: "ca = []\n",
+			after:  "ca = [\"new\"]\n",
+		},
+		{
+			name:   "inline",
+			before: "ca = [\"a\", 'b'] # trusted\n",
+			after:  "ca = [\"a\", 'b', \"new\"] # trusted\n",
+		},
+		{
+			name:   "multi-line with comments",
+			before: "ca = [\n  \"a\", # first\n  \"b\" # second ]\n]\nnext = 1\n",
+			after:  "ca = [\n  \"a\", # first\n  \"b\", \"new\" # second ]\n]\nnext = 1\n",
+		},
+		{
+			name:   "trailing comma",
+			before: "ca = [\n  \"a\",\n]\n",
+			after:  "ca = [\n  \"a\", \"new\",\n]\n",
+		},
+		{
+			name:   "strings with brackets",
+			before: "ca = [\"]\", '''\n[x]'''] # ]\n",
+			after:  "ca = [\"]\", '''\n[x]''', \"new\"] # ]\n",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			doc := &tomlDocument{src: c.before}
+			if err := doc.appendTo(nil, -1, "ca", tomlString("new")); err != nil {
+				t.Fatal(err)
+			}
+			if err := doc.check(); err != nil {
+				t.Fatal(err)
+			}
+			if doc.src != c.after {
+				t.Errorf("got\n%s\nwant\n%s", doc.src, c.after)
+			}
+		})
+	}
+}
+
+func TestTOMLDocumentSet(t *testing.T) {
+	before := `# managed by hand
+title = "registry" # keep me
+
+[a]
+  # indented
+  x = 1
+
+[ "b.c" . d ]
+y = """
+z = 2
+"""
+
+[e]
+`
+	doc := &tomlDocument{src: before}
+	for _, edit := range []struct {
+		path  []string
+		key   string
+		value string
+	}{
+		{nil, "title", tomlString("changed")},
+		{nil, "server", tomlString("https://example.com")},
+		{[]string{"a"}, "z", "2"},
+		{[]string{"b.c", "d"}, "z", "3"},
+		{[]string{"e"}, "z", "4"},
+		{[]string{"f", "g.h"}, "z", "5"},
+	} {
+		if err := doc.set(edit.path, -1, edit.key, edit.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := doc.check(); err != nil {
+		t.Fatal(err)
+	}
+	want := `# managed by hand
+title = "changed" # keep me
+server = "https://example.com"
+
+[a]
+  # indented
+  x = 1
+  z = 2
+
+[ "b.c" . d ]
+y = """
+z = 2
+"""
+z = 3
+
+[e]
+z = 4
+
+[f."g.h"]
+  z = 5
+`
+	if doc.src != want {
+		t.Errorf("got\n%s\nwant\n%s", doc.src, want)
+	}
+}
+
+func TestTOMLDocumentCheck(t *testing.T) {
+	// registry is not found as a table, so adding it again must be caught
+	doc := &tomlDocument{src: "registry = { \"example.com\" = { ca = [] } }\n"}
+	if err := doc.set([]string{"registry", "example.com"}, -1, "ca", tomlStrings([]string{"ca.pem"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := doc.check(); err == nil {
+		t.Errorf("expected an error for a redefined table, got\n%s", doc.src)
+	}
+}
+
+func TestMergeHostsTOML(t *testing.T) {
+	hostsPath := path.Join(t.TempDir(), "hosts.toml")
+	before := `# registry mirror, see RUNBOOK.md
+server = "https://registry.corp"
+ca = "/etc/ssl/old.pem" # expires in June
+
+[host."https://mirror.corp"]
+  capabilities = ["pull", "resolve"]
+
+[host."https://registry.corp:443"]
+  capabilities = ["pull", "resolve", "push"]
+  ca = [
+    "/etc/ssl/old.pem", # still in use
+  ]
+`
+	if err := os.WriteFile(hostsPath, []byte(before), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := mergeHostsTOML(hostsPath, "registry.corp:443", "/etc/containerd/certs.d/registry.corp:443/ca.crt"); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.ReadFile(hostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# registry mirror, see RUNBOOK.md
+server = "https://registry.corp"
+ca = ["/etc/ssl/old.pem", "/etc/containerd/certs.d/registry.corp:443/ca.crt"] # expires in June
+
+[host."https://mirror.corp"]
+  capabilities = ["pull", "resolve"]
+
+[host."https://registry.corp:443"]
+  capabilities = ["pull", "resolve", "push"]
+  ca = [
+    "/etc/ssl/old.pem", "/etc/containerd/certs.d/registry.corp:443/ca.crt", # still in use
+  ]
+`
+	if string(after) != want {
+		t.Errorf("got\n%s\nwant\n%s", after, want)
+	}
+
+	// a second run finds the certificate everywhere
+	if err := mergeHostsTOML(hostsPath, "registry.corp:443", "/etc/containerd/certs.d/registry.corp:443/ca.crt"); err != nil {
+		t.Fatal(err)
+	}
+	again, err := os.ReadFile(hostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != want {
+		t.Errorf("second run changed hosts.toml\n%s", again)
+	}
+}
+
+func TestMergeHostsTOMLNew(t *testing.T) {
+	hostsPath := path.Join(t.TempDir(), "hosts.toml")
+	if err := mergeHostsTOML(hostsPath, "registry.corp", "/ca.crt"); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.ReadFile(hostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "server = \"https://registry.corp\"\nca = \"/ca.crt\"\n"
+	if string(after) != want {
+		t.Errorf("got\n%s\nwant\n%s", after, want)
+	}
+}
+
+func TestMergeBuildkitTOML(t *testing.T) {
+	before := `# shared builder
+debug = true
+
+[worker.oci]
+  max-parallelism = 4 # CI runners are small
+
+[registry."docker.io"]
+  mirrors = ["mirror.corp"]
+
+[registry."registry.corp"]
+  # keep the old one until everything is renewed
+  ca = ["/etc/buildkit/old.pem"]
+`
+	after, err := mergeBuildkitTOML([]byte(before), []string{"registry.corp", "10.0.0.1"}, "/etc/buildkit/confiar.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# shared builder
+debug = true
+
+[worker.oci]
+  max-parallelism = 4 # CI runners are small
+
+[registry."docker.io"]
+  mirrors = ["mirror.corp"]
+
+[registry."registry.corp"]
+  # keep the old one until everything is renewed
+  ca = ["/etc/buildkit/old.pem", "/etc/buildkit/confiar.pem"]
+
+[registry."10.0.0.1"]
+  ca = ["/etc/buildkit/confiar.pem"]
+`
+	if string(after) != want {
+		t.Errorf("got\n%s\nwant\n%s", after, want)
+	}
+
+	unchanged, err := mergeBuildkitTOML(after, []string{"registry.corp", "10.0.0.1"}, "/etc/buildkit/confiar.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(unchanged) != want {
+		t.Errorf("second run changed buildkitd.toml\n%s", unchanged)
+	}
+}
@@ -0,0 +1,242 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package target
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// toolchainEnv are the variables pointed at the combined bundle, for tools
+// which bring their own certificate authorities or need to be told where the
+// system's are
+var toolchainEnv = []string{
+	"SSL_CERT_FILE",       // OpenSSL, Go, Ruby
+	"REQUESTS_CA_BUNDLE",  // Python requests
+	"PIP_CERT",            // pip, whose pip.conf does not allow repeating [global]
+	"NODE_EXTRA_CA_CERTS", // Node.js
+	"NPM_CONFIG_CAFILE",   // npm
+	"CURL_CA_BUNDLE",      // curl
+	"GIT_SSL_CAINFO",      // git
+}
+
+// systemBundles are where the combined bundle starts from, the first one found
+// is used
+var systemBundles = []string{
+	debianTrust.bundle,
+	rhelTrust.bundle,
+	archTrust.bundle,
+	suseTrust.bundle,
+	"/etc/ssl/cert.pem",
+}
+
+// Toolchains makes language runtimes and developer tools trust the system's
+// certificate authorities plus the installed ones, through environment
+// variables and, per-user, their configuration files.
+type Toolchains struct {
+	CertPath string
+	Root     string
+
+	// Rootless configures the current user below Home instead of every login
+	Rootless bool
+	Home     string
+}
+
+type toolchainLayout struct {
+	dataDir string
+
+	// configBlocks maps files to the managed block confiar keeps in them,
+	// given the path of the combined bundle
+	configBlocks map[string]func(bundle string) string
+}
+
+func (t *Toolchains) layout() (*toolchainLayout, error) {
+	if !t.Rootless {
+		return &toolchainLayout{
+			dataDir: "/usr/local/share/confiar",
+			configBlocks: map[string]func(string) string{
+				"/etc/profile.d/confiar.sh":       shellExports,
+				"/etc/environment.d/confiar.conf": environmentAssignments,
+			},
+		}, nil
+	}
+
+	home, err := homeDir(t.Root, t.Home)
+	if err != nil {
+		return nil, err
+	}
+	dataHome, err := xdgDir(t.Root, t.Home, "XDG_DATA_HOME", ".local/share")
+	if err != nil {
+		return nil, err
+	}
+	return &toolchainLayout{
+		dataDir: path.Join(dataHome, "confiar"),
+		configBlocks: map[string]func(string) string{
+			path.Join(home, ".profile"):                           shellExports,
+			path.Join(home, ".config/environment.d/confiar.conf"): environmentAssignments,
+			// environment variables do not reach tools started outside of a
+			// login session, such as from an IDE
+			path.Join(home, ".curlrc"): func(bundle string) string {
+				return fmt.Sprintf("cacert = %q\n", bundle)
+			},
+			path.Join(home, ".gitconfig"): func(bundle string) string {
+				return fmt.Sprintf("[http]\n\tsslCAInfo = %s\n", bundle)
+			},
+			path.Join(home, ".npmrc"): func(bundle string) string {
+				return fmt.Sprintf("cafile=%s\n", bundle)
+			},
+		},
+	}, nil
+}
+
+func shellExports(bundle string) string {
+	var b strings.Builder
+	for _, name := range toolchainEnv {
+		fmt.Fprintf(&b, "export %s=%q\n", name, bundle)
+	}
+	return b.String()
+}
+
+func environmentAssignments(bundle string) string {
+	var b strings.Builder
+	for _, name := range toolchainEnv {
+		fmt.Fprintf(&b, "%s=%s\n", name, bundle)
+	}
+	return b.String()
+}
+
+func (t *Toolchains) Install() error {
+	certBytes, certData, err := readCertificate(t.CertPath)
+	if err != nil {
+		return err
+	}
+	layout, err := t.layout()
+	if err != nil {
+		return err
+	}
+
+	certDir := rootPath(t.Root, path.Join(layout.dataDir, "certs"))
+	log.Debug().Str("path", certDir).Msg("creating directory")
+	if err := os.MkdirAll(certDir, 0755); err != nil {
+		return err
+	}
+	dstpath := path.Join(certDir, certName(certData)+".crt")
+	log.Debug().Str("file", dstpath).Msg("writing certificate")
+	if err := os.WriteFile(dstpath, certBytes, 0644); err != nil {
+		return err
+	}
+
+	bundle := path.Join(layout.dataDir, "ca-bundle.pem")
+	if err := t.buildBundle(certDir, bundle); err != nil {
+		return err
+	}
+	for file, block := range layout.configBlocks {
+		if _, err := setManagedBlock(rootPath(t.Root, file), "", block(bundle)); err != nil {
+			return err
+		}
+	}
+
+	log.Info().Str("file", dstpath).Str("bundle", rootPath(t.Root, bundle)).Msg("certificate installed, log in again for the environment to take effect")
+	return nil
+}
+
+func (t *Toolchains) Uninstall() error {
+	_, certData, err := readCertificate(t.CertPath)
+	if err != nil {
+		return err
+	}
+	layout, err := t.layout()
+	if err != nil {
+		return err
+	}
+
+	certDir := rootPath(t.Root, path.Join(layout.dataDir, "certs"))
+	dstpath := path.Join(certDir, certName(certData)+".crt")
+	if err := os.Remove(dstpath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	remaining, err := filepath.Glob(path.Join(certDir, "*.crt"))
+	if err != nil {
+		return err
+	}
+	bundle := path.Join(layout.dataDir, "ca-bundle.pem")
+	if len(remaining) > 0 {
+		log.Debug().Strs("certificates", remaining).Msg("other certificates remain installed")
+		if err := t.buildBundle(certDir, bundle); err != nil {
+			return err
+		}
+		log.Info().Str("file", dstpath).Msg("certificate uninstalled")
+		return nil
+	}
+
+	for file := range layout.configBlocks {
+		if _, err := setManagedBlock(rootPath(t.Root, file), "", ""); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(rootPath(t.Root, layout.dataDir)); err != nil {
+		return err
+	}
+	log.Info().Str("file", dstpath).Msg("certificate uninstalled, toolchain configuration removed")
+	return nil
+}
+
+// buildBundle writes the system bundle followed by every certificate in
+// certDir to bundle. It is a copy, so it goes stale when the system's
+// certificate authorities are updated until confiar installs again.
+func (t *Toolchains) buildBundle(certDir string, bundle string) error {
+	var contents []byte
+	for _, candidate := range systemBundles {
+		data, err := os.ReadFile(rootPath(t.Root, candidate))
+		if err != nil {
+			continue
+		}
+		log.Debug().Str("bundle", candidate).Msg("found system bundle")
+		contents = data
+		break
+	}
+	if contents == nil {
+		log.Warn().Msg("no system bundle found, toolchains will only trust confiar certificates")
+	}
+
+	certFiles, err := filepath.Glob(path.Join(certDir, "*.crt"))
+	if err != nil {
+		return err
+	}
+	for _, certFile := range certFiles {
+		data, err := os.ReadFile(certFile)
+		if err != nil {
+			return err
+		}
+		if len(contents) > 0 && contents[len(contents)-1] != '\n' {
+			contents = append(contents, '\n')
+		}
+		contents = append(contents, data...)
+	}
+
+	fullpath := rootPath(t.Root, bundle)
+	log.Debug().Str("file", fullpath).Int("certificates", len(certFiles)).Msg("writing combined bundle")
+	return replaceFile(fullpath, contents)
+}
@@ -17,15 +17,17 @@ limitations under the License.
 package internal
 
 import (
+	"context"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/wilsonehusin/confiar/internal/audit"
+	"github.com/wilsonehusin/confiar/internal/certs"
 	"github.com/wilsonehusin/confiar/internal/cryptographer"
 	"github.com/wilsonehusin/confiar/internal/target"
 )
@@ -33,67 +35,348 @@ import (
 var cryptoBackend cryptographer.Cryptographer
 var installTarget target.Target
 
-func NewTLSSelfAuthority(backendType string, names []string, ips []string, outDir string) error {
+func newCryptographer(backendType string) (cryptographer.Cryptographer, error) {
 	switch backendType {
 	case "gostd":
-		cryptoBackend = &cryptographer.GoStd{}
+		return &cryptographer.GoStd{}, nil
 	default:
-		return fmt.Errorf("unknown cryptographer backend type: %w", backendType)
+		return nil, fmt.Errorf("unknown cryptographer backend type: %s", backendType)
+	}
+}
+
+func NewTLSSelfAuthority(backendType string, names []string, ips []string, outDir string) error {
+	var err error
+	cryptoBackend, err = newCryptographer(backendType)
+	if err != nil {
+		return err
 	}
 	return cryptoBackend.NewTLSSelfAuthority(names, ips, outDir)
 }
 
-func InstallTLS(certSrc string, targetType string, extraNames []string, extraIPs []string) error {
-	removeTempCert := false
+type InstallConfig struct {
+	CertSrc    string
+	Target     string
+	ExtraNames []string
+	ExtraIPs   []string
 
-	var certPath string
+	// Root is prepended to every path a target writes to, commands are run
+	// inside it through chroot unless SkipCommands
+	Root         string
+	SkipCommands bool
 
-	if strings.HasPrefix(certSrc, "http://") {
-		log.Info().Str("certSrc", certSrc).Msg("downloading to local path")
+	JavaHome         string
+	KeystorePassword string
 
-		resp, err := http.Get(certSrc)
-		if err != nil {
-			return fmt.Errorf("unable to get certificate from remote: %w", err)
-		}
-		defer resp.Body.Close()
+	RegistryPorts  []int
+	Rootless       bool
+	BuildkitConfig string
 
-		tempCertPath, err := ioutil.TempFile(os.TempDir(), "confiar-cert-")
-		if err != nil {
-			return fmt.Errorf("unable to create local copy of certificate: %w", err)
-		}
-		if _, err := io.Copy(tempCertPath, resp.Body); err != nil {
-			return fmt.Errorf("unable to write certificate to local: %w", err)
+	// Home is the home directory of the user to configure, inside Root, for
+	// targets which otherwise use the current user's
+	Home string
+
+	RunnerDockerVolumes bool
+
+	CertDir string
+
+	FilePath  string
+	FileOwner string
+	FileMode  os.FileMode
+
+	HostsAddress string
+
+	// DryRun shows what targets supporting it would change
+	DryRun bool
+}
+
+func InstallTLS(config *InstallConfig) error {
+	fetched, err := fetchCertificate(config.CertSrc, "")
+	if err != nil {
+		return err
+	}
+	return installFetched(fetched, config)
+}
+
+// WatchTLS installs the certificate from config.CertSrc, then keeps checking it
+// every interval and installs it again whenever it changes, until interrupted.
+func WatchTLS(config *InstallConfig, interval time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Info().Str("certSrc", config.CertSrc).Dur("interval", interval).Msg("watching certificate for changes")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var etag, fingerprint string
+	for {
+		etag, fingerprint = watchOnce(config, etag, fingerprint)
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("stopped watching certificate")
+			return nil
+		case <-ticker.C:
 		}
-		certPath = tempCertPath.Name()
-		removeTempCert = true
-	} else {
-		certPath = certSrc
 	}
+}
 
-	log.Info().Str("certPath", certPath).Msg("installing certificate")
-	switch targetType {
+// watchOnce returns the ETag and fingerprint to compare against next time,
+// which are left unchanged when installation fails so that it is retried
+func watchOnce(config *InstallConfig, etag string, fingerprint string) (string, string) {
+	certSrc := config.CertSrc
+	fetched, err := fetchCertificate(certSrc, etag)
+	if err != nil {
+		log.Error().Err(err).Str("certSrc", certSrc).Msg("unable to fetch certificate")
+		return etag, fingerprint
+	}
+	if fetched.notModified {
+		log.Debug().Str("certSrc", certSrc).Msg("certificate not modified")
+		return etag, fingerprint
+	}
+
+	newFingerprint, err := fileFingerprint(fetched.path)
+	if err != nil {
+		log.Error().Err(err).Str("certSrc", certSrc).Msg("unable to read certificate")
+		fetched.cleanup()
+		return etag, fingerprint
+	}
+	if newFingerprint == fingerprint {
+		log.Debug().Str("fingerprint", fingerprint).Msg("certificate unchanged")
+		fetched.cleanup()
+		return fetched.etag, fingerprint
+	}
+
+	log.Info().Str("from", fingerprint).Str("to", newFingerprint).Msg("certificate changed")
+	if err := installFetched(fetched, config); err != nil {
+		log.Error().Err(err).Str("fingerprint", newFingerprint).Msg("unable to install certificate, retrying next interval")
+		return "", fingerprint
+	}
+	return fetched.etag, newFingerprint
+}
+
+func fileFingerprint(certPath string) (string, error) {
+	certBytes, err := os.ReadFile(certPath)
+	if err != nil {
+		return "", err
+	}
+	certData, err := certs.ParsePEM(certBytes)
+	if err != nil {
+		return "", err
+	}
+	return certs.Fingerprint(certData.Raw), nil
+}
+
+func newTarget(config *InstallConfig, certPath string) (target.Target, error) {
+	runner := &target.ExecRunner{
+		Root:         config.Root,
+		SkipCommands: config.SkipCommands,
+	}
+	switch config.Target {
 	case "stdout":
-		installTarget = &target.Stdout{
+		return &target.Stdout{
 			CertPath: certPath,
-		}
+		}, nil
 	case "docker":
-		installTarget = &target.Docker{
+		return &target.Docker{
 			CertPath:   certPath,
-			ExtraHosts: append(extraNames, extraIPs...),
-		}
+			ExtraHosts: append(config.ExtraNames, config.ExtraIPs...),
+			Root:       config.Root,
+		}, nil
+	case "containerd":
+		return &target.Containerd{
+			CertPath:   certPath,
+			ExtraHosts: append(config.ExtraNames, config.ExtraIPs...),
+			Root:       config.Root,
+		}, nil
+	case "containers":
+		return &target.Containers{
+			CertPath:   certPath,
+			ExtraHosts: append(config.ExtraNames, config.ExtraIPs...),
+			Root:       config.Root,
+			Ports:      config.RegistryPorts,
+			Rootless:   config.Rootless,
+			Home:       config.Home,
+		}, nil
+	case "k3s", "rke2":
+		return &target.K3s{
+			CertPath:     certPath,
+			ExtraHosts:   append(config.ExtraNames, config.ExtraIPs...),
+			Root:         config.Root,
+			Distribution: config.Target,
+			DryRun:       config.DryRun,
+		}, nil
+	case "buildkit":
+		return &target.BuildKit{
+			CertPath:   certPath,
+			ExtraHosts: append(config.ExtraNames, config.ExtraIPs...),
+			Root:       config.Root,
+			ConfigPath: config.BuildkitConfig,
+			Rootless:   config.Rootless,
+			Home:       config.Home,
+			DryRun:     config.DryRun,
+		}, nil
+	case "gitlab-runner":
+		return &target.GitLabRunner{
+			CertPath:      certPath,
+			ExtraHosts:    append(config.ExtraNames, config.ExtraIPs...),
+			Root:          config.Root,
+			Rootless:      config.Rootless,
+			Home:          config.Home,
+			DockerVolumes: config.RunnerDockerVolumes,
+			DryRun:        config.DryRun,
+		}, nil
+	case "toolchains":
+		return &target.Toolchains{
+			CertPath: certPath,
+			Root:     config.Root,
+			Rootless: config.Rootless,
+			Home:     config.Home,
+		}, nil
+	case "openssl-dir":
+		return &target.OpenSSLDir{
+			CertPath: certPath,
+			Dir:      config.CertDir,
+			Root:     config.Root,
+		}, nil
+	case "file":
+		return &target.File{
+			CertPath:     certPath,
+			ExtraHosts:   append(config.ExtraNames, config.ExtraIPs...),
+			Root:         config.Root,
+			PathTemplate: config.FilePath,
+			Owner:        config.FileOwner,
+			Mode:         config.FileMode,
+		}, nil
+	case "hosts":
+		return &target.Hosts{
+			CertPath:   certPath,
+			ExtraNames: config.ExtraNames,
+			Root:       config.Root,
+			Address:    config.HostsAddress,
+		}, nil
+	case "debian":
+		return &target.Debian{
+			CertPath: certPath,
+			Root:     config.Root,
+			Runner:   runner,
+		}, nil
+	case "rhel":
+		return &target.RHEL{
+			CertPath: certPath,
+			Root:     config.Root,
+			Runner:   runner,
+		}, nil
+	case "alpine":
+		return &target.Alpine{
+			CertPath: certPath,
+			Root:     config.Root,
+			Runner:   runner,
+		}, nil
+	case "arch":
+		return &target.Arch{
+			CertPath: certPath,
+			Root:     config.Root,
+			Runner:   runner,
+		}, nil
+	case "suse":
+		return &target.SUSE{
+			CertPath: certPath,
+			Root:     config.Root,
+			Runner:   runner,
+		}, nil
+	case "nss":
+		return &target.NSS{
+			CertPath: certPath,
+			Root:     config.Root,
+			Home:     config.Home,
+			Runner:   runner,
+		}, nil
+	case "java":
+		return &target.Java{
+			CertPath: certPath,
+			Root:     config.Root,
+			JavaHome: config.JavaHome,
+			Password: config.KeystorePassword,
+		}, nil
+	case "system":
+		return &target.System{
+			CertPath: certPath,
+			Root:     config.Root,
+			Runner:   runner,
+		}, nil
 	default:
-		return fmt.Errorf("unknown installation target: %s", targetType)
+		return nil, fmt.Errorf("unknown installation target: %s", config.Target)
+	}
+}
+
+func installFetched(fetched *fetchedCert, config *InstallConfig) error {
+	defer fetched.cleanup()
+	certPath := fetched.path
+
+	log.Info().Str("certPath", certPath).Msg("installing certificate")
+	var err error
+	installTarget, err = newTarget(config, certPath)
+	if err != nil {
+		recordInstall(config, audit.ActionInstall, certPath, err)
+		return err
 	}
 	if err := installTarget.Install(); err != nil {
+		recordInstall(config, audit.ActionInstall, certPath, err)
 		return fmt.Errorf("install certificate: %w", err)
 	}
+	recordInstall(config, audit.ActionInstall, certPath, nil)
+	return nil
+}
+
+// UninstallTLS removes the certificate from config.CertSrc from the target,
+// provided the target knows how to.
+func UninstallTLS(config *InstallConfig) error {
+	fetched, err := fetchCertificate(config.CertSrc, "")
+	if err != nil {
+		return err
+	}
+	defer fetched.cleanup()
 
-	if removeTempCert {
-		// only remove tempfile on successful install
-		// leave the tempfile for debugging on failure
-		log.Info().Str("certPath", certPath).Msg("removing cert from local path")
-		os.Remove(certPath)
+	installTarget, err = newTarget(config, fetched.path)
+	if err != nil {
+		return err
+	}
+	uninstaller, ok := installTarget.(target.Uninstaller)
+	if !ok {
+		return fmt.Errorf("installation target %s does not support uninstall", config.Target)
 	}
 
+	log.Info().Str("certPath", fetched.path).Msg("uninstalling certificate")
+	if err := uninstaller.Uninstall(); err != nil {
+		recordInstall(config, audit.ActionUninstall, fetched.path, err)
+		return fmt.Errorf("uninstall certificate: %w", err)
+	}
+	recordInstall(config, audit.ActionUninstall, fetched.path, nil)
 	return nil
 }
+
+func recordInstall(config *InstallConfig, action string, certPath string, installErr error) {
+	event := audit.Event{
+		Action: action,
+		Result: audit.ResultSuccess,
+		Source: config.CertSrc,
+		Target: config.Target,
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		event.Client = hostname
+	}
+	if installErr != nil {
+		event.Result = audit.ResultFailure
+		event.Error = installErr.Error()
+	}
+	if certBytes, err := os.ReadFile(certPath); err == nil {
+		if certData, err := certs.ParsePEM(certBytes); err == nil {
+			event.Fingerprint = certs.Fingerprint(certData.Raw)
+			event.Serial = certData.SerialNumber.Text(16)
+			event.Names = certData.DNSNames
+			for _, ip := range certData.IPAddresses {
+				event.IPs = append(event.IPs, ip.String())
+			}
+		}
+	}
+	audit.Record(event)
+}